@@ -1,84 +1,384 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
 
 	"github.com/Tokebay/yandex/config"
 
+	"github.com/Tokebay/yandex/internal/app/grpcserver"
 	"github.com/Tokebay/yandex/internal/app/handlers"
 	"github.com/Tokebay/yandex/internal/app/storage"
 	logger "github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/metrics"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/Tokebay/yandex/internal/screening"
+	"github.com/Tokebay/yandex/internal/tracing"
 	"github.com/go-chi/chi"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 func main() {
 	if err := run(); err != nil {
-		fmt.Println("Error", err)
+		// до инициализации логгера, например при ошибке конфигурации, logger.Log ничего не пишет
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		logger.Log.Error("Service stopped with error", zap.Error(err))
+		logger.Log.Sync()
+		os.Exit(1)
 	}
 }
 
 func run() error {
+	// конфиг для запуска
+	cfg, err := config.NewConfig()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.PrintConfig {
+		return cfg.Print(os.Stdout)
+	}
+
 	//Инициализируется логгер
-	logger.Initialize("info")
+	if err := logger.Initialize(cfg.LogLevel); err != nil {
+		return err
+	}
+	keys, err := handlers.LoadKeySet(cfg)
+	if err != nil {
+		return err
+	}
+	handlers.SetKeySet(keys)
 
-	// конфиг для запуска
-	cfg := config.NewConfig()
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		logger.Log.Error("Error setting up tracing", zap.Error(err))
+		return err
+	}
+	// спаны досылаются последними, в том числе спаны удалений, дописанных при остановке
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Log.Error("Error shutting down tracing", zap.Error(err))
+		}
+	}()
+	if cfg.JWTSecret == "" && cfg.JWTAlgorithm == handlers.AlgHS256 {
+		logger.Log.Warn("JWT secret is not configured, using random secret: tokens will not survive restart")
+	}
 
+	dedupScope, err := storage.ParseDedupScope(cfg.DedupScope)
+	if err != nil {
+		logger.Log.Error("Error in dedup scope", zap.Error(err))
+		return err
+	}
 	mapStorage := storage.NewMapStorage()
+	mapStorage.SetDedupScope(dedupScope)
 	var fileStorage *handlers.Producer
+	var dbStorage *storage.PostgreSQLStorage
 	var shortener *handlers.URLShortener
-	var err error
-	fmt.Printf("FileStoragePath: %s; DSN: %s \n", cfg.FileStoragePath, cfg.DSN)
-
 	if cfg.DSN != "" {
-		fmt.Println("connect to DB")
+		logger.Log.Info("Using PostgreSQL storage")
 		// Инициализировать и использовать PostgreSQL хранилище
-		dbStorage, err := storage.NewPostgreSQLStorage(cfg.DSN)
+		dbStorage, err = storage.NewPostgreSQLStorage(cfg.DSN)
 		if err != nil {
 			logger.Log.Error("Error in NewPostgreSQLStorage", zap.Error(err))
 			return err
 		}
 
-		shortener = handlers.NewURLShortener(cfg, dbStorage, nil)
+		dbStorage.SetDedupScope(dedupScope)
+		metrics.RegisterDBStats(dbStorage.DB(), "shortener")
+		shortener = handlers.NewURLShortener(cfg, storage.NewInstrumentedStorage(dbStorage, "postgres"), nil)
+		shortener.AddReadinessCheck("migrations", dbStorage.CheckMigrations)
 
 	} else {
-		fileStorage, err = handlers.NewProducer(cfg.FileStoragePath)
+		logger.Log.Info("Using file storage", zap.String("path", cfg.FileStoragePath))
+		syncPolicy, err := handlers.ParseSyncPolicy(cfg.FileSyncPolicy)
+		if err != nil {
+			logger.Log.Error("Error in file sync policy", zap.Error(err))
+			return err
+		}
+		fileStorage, err = handlers.NewProducer(cfg.FileStoragePath,
+			handlers.WithSyncPolicy(syncPolicy, 0),
+			handlers.WithCompactInterval(cfg.FileCompactInterval),
+		)
 		if err != nil {
 			logger.Log.Error("Error in NewProducer", zap.Error(err))
 			return err
 		}
-		defer fileStorage.Close()
 
-		urlDataSlice, err := fileStorage.LoadInitialData()
+		if err := loadFileStorage(fileStorage, mapStorage); err != nil {
+			fileStorage.Close()
+			return err
+		}
+
+		shortener = handlers.NewURLShortener(cfg, storage.NewInstrumentedStorage(mapStorage, "memory"), fileStorage)
+	}
+
+	metrics.RegisterDeleteQueue(shortener.DeleteQueueLen, shortener.DeleteQueueCap)
+
+	// SIGINT/SIGTERM запускают плавную остановку
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.BlocklistFile != "" || cfg.ScreeningURL != "" {
+		screener, err := newScreener(ctx, cfg)
+		if err != nil {
+			logger.Log.Error("Error setting up URL screening", zap.Error(err))
+			return err
+		}
+		shortener.SetScreener(screener)
+	}
+
+	// фоновое удаление давно истекших ссылок и ответов на запросы с Idempotency-Key
+	reaperCtx, cancelReaper := context.WithCancel(ctx)
+	defer cancelReaper()
+	go shortener.RunExpiredURLsReaper(reaperCtx, cfg.ExpiredReapInterval, cfg.ExpiredRetention)
+	go shortener.RunIdempotencyKeysCleaner(reaperCtx, cfg.IdempotencyTTL)
+
+	r := createRouter(shortener, cfg)
+	server := &http.Server{
+		Addr:         cfg.ServerAddress,
+		Handler:      r,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	servers := []*http.Server{server}
+	if cfg.EnableHTTPS {
+		server.TLSConfig, err = newTLSConfig(cfg)
 		if err != nil {
-			logger.Log.Error("Error loading data from file", zap.Error(err))
+			logger.Log.Error("Error loading TLS certificate", zap.Error(err))
 			return err
 		}
+	}
+	logger.Log.Info("Server is starting", zap.String("address", server.Addr), zap.Bool("https", cfg.EnableHTTPS))
+
+	// Запускается HTTP-сервер, который начинает прослушивание указанного адреса и использует маршрутизатор r для обработки запросов.
+	serverErr := make(chan error, 4)
+	go func() {
+		var err error
+		if cfg.EnableHTTPS {
+			// сертификат уже загружен в TLSConfig
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
 
-		for _, urlData := range urlDataSlice {
-			// fmt.Printf("urlData.ShortURL %s;  urlData.OriginalUR %s \n", urlData.ShortURL, urlData.OriginalURL)
-			err := mapStorage.SaveURL(urlData.ShortURL, urlData.OriginalURL)
-			if err != nil {
-				logger.Log.Error("Error saving URL to storage", zap.Error(err))
-				return err
+	if cfg.EnableHTTPS && cfg.HTTPRedirectAddress != "" {
+		redirectServer := &http.Server{
+			Addr:         cfg.HTTPRedirectAddress,
+			Handler:      httpsRedirectHandler(cfg.ServerAddress),
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+		}
+		servers = append(servers, redirectServer)
+		logger.Log.Info("HTTPS redirect server is starting", zap.String("address", redirectServer.Addr))
+		go func() {
+			if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- err
 			}
+		}()
+	}
+
+	if cfg.MetricsAddress != "" {
+		metricsServer := &http.Server{
+			Addr:         cfg.MetricsAddress,
+			Handler:      metricsRouter(),
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
 		}
-		shortener = handlers.NewURLShortener(cfg, mapStorage, fileStorage)
+		servers = append(servers, metricsServer)
+		logger.Log.Info("Metrics server is starting", zap.String("address", metricsServer.Addr))
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- err
+			}
+		}()
 	}
 
-	r := createRouter(shortener, cfg)
-	addr := cfg.ServerAddress
-	logger.Log.Info("Server is starting", zap.String("address", addr))
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddress != "" {
+		listener, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			logger.Log.Error("Error listening gRPC address", zap.Error(err))
+			shutdown(servers, nil, cfg.ShutdownTimeout, shortener, fileStorage, dbStorage)
+			return err
+		}
+		grpcServer = grpcserver.NewServer(shortener)
+		logger.Log.Info("gRPC server is starting", zap.String("address", cfg.GRPCAddress))
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+				serverErr <- err
+			}
+		}()
+	}
+
+	select {
+	case err = <-serverErr:
+		logger.Log.Error("Failed to start server", zap.Error(err))
+	case <-ctx.Done():
+		logger.Log.Info("Shutdown signal received")
+	}
 
-	// Запускается HTTP-сервер, который начинает прослушивание указанного адреса addr и использует маршрутизатор r для обработки запросов.
-	err = http.ListenAndServe(addr, r)
+	cancelReaper()
+	shutdown(servers, grpcServer, cfg.ShutdownTimeout, shortener, fileStorage, dbStorage)
+	return err
+}
+
+// shutdown останавливает сервис в порядке зависимостей: сначала перестаем принимать запросы
+// и дожидаемся текущих, затем дописываем очереди удаления и переходов, и только потом закрываем хранилища
+func shutdown(servers []*http.Server, grpcServer *grpc.Server, timeout time.Duration, shortener *handlers.URLShortener,
+	fileStorage *handlers.Producer, dbStorage *storage.PostgreSQLStorage) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Log.Error("Error shutting down server", zap.String("address", server.Addr), zap.Error(err))
+		}
+	}
+	if grpcServer != nil {
+		stopGRPCServer(ctx, grpcServer)
+	}
+
+	shortener.StopDeleteWorkers()
+	shortener.StopClickRecorder()
+
+	if fileStorage != nil {
+		if err := fileStorage.Close(); err != nil {
+			logger.Log.Error("Error closing file storage", zap.Error(err))
+		}
+	}
+	if dbStorage != nil {
+		dbStorage.Close()
+	}
+	logger.Log.Info("Server stopped")
+}
+
+// stopGRPCServer дожидается текущих вызовов, а по истечении ctx обрывает их
+func stopGRPCServer(ctx context.Context, grpcServer *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.Log.Error("Error shutting down gRPC server", zap.Error(ctx.Err()))
+		grpcServer.Stop()
+		<-stopped
+	}
+}
+
+// newScreener собирает проверку адресов назначения. Список блокировки перечитывается до отмены ctx
+func newScreener(ctx context.Context, cfg *config.Config) (*screening.Screener, error) {
+	var blocklist *screening.Blocklist
+	if cfg.BlocklistFile != "" {
+		var err error
+		blocklist, err = screening.LoadBlocklist(cfg.BlocklistFile)
+		if err != nil {
+			return nil, err
+		}
+		logger.Log.Info("Blocklist loaded", zap.String("path", cfg.BlocklistFile), zap.Int("rules", blocklist.Len()))
+		go blocklist.Watch(ctx, cfg.BlocklistReloadInterval)
+	}
+	var lookup screening.Lookup
+	if cfg.ScreeningURL != "" {
+		lookup = screening.NewHTTPLookup(cfg.ScreeningURL, cfg.ScreeningTimeout)
+	}
+	return screening.New(blocklist, lookup), nil
+}
+
+// loadFileStorage восстанавливает состояние хранилища в памяти из файла
+func loadFileStorage(fileStorage *handlers.Producer, mapStorage *storage.MapStorage) error {
+	urlDataSlice, err := fileStorage.LoadInitialData()
 	if err != nil {
-		logger.Log.Fatal("Failed to start server", zap.Error(err))
+		logger.Log.Error("Error loading data from file", zap.Error(err))
+		return err
+	}
+
+	for _, urlData := range urlDataSlice {
+		// в старых файлах short_url хранился вместе с BaseURL
+		mURL := models.ShortenURL{
+			UUID:        urlData.UUID,
+			ShortURL:    path.Base(urlData.ShortURL),
+			OriginalURL: urlData.OriginalURL,
+			UserID:      urlData.UserID,
+			DeletedFlag: urlData.DeletedFlag,
+		}
+		if urlData.ExpiresAt != nil {
+			mURL.ExpiresAt = *urlData.ExpiresAt
+		}
+		// ссылки, созданные при другой политике дедупликации, восстанавливаются все
+		if err := mapStorage.RestoreURL(mURL); err != nil {
+			logger.Log.Error("Error saving URL to storage", zap.Error(err))
+			return err
+		}
+	}
+
+	clicks, err := fileStorage.LoadClicks()
+	if err != nil {
+		logger.Log.Error("Error loading clicks from file", zap.Error(err))
+		return err
+	}
+	if err := mapStorage.SaveClicks(context.Background(), clicks); err != nil {
 		return err
 	}
 
+	users, err := fileStorage.LoadUsers()
+	if err != nil {
+		logger.Log.Error("Error loading users from file", zap.Error(err))
+		return err
+	}
+	for _, user := range users {
+		// запись без email резервирует идентификаторы анонимных пользователей
+		if !user.IsRegistered() {
+			mapStorage.RestoreLastUserID(user.ID)
+			continue
+		}
+		if err := mapStorage.RegisterUser(context.Background(), user); err != nil {
+			return err
+		}
+	}
+
+	apiKeys, err := fileStorage.LoadAPIKeys()
+	if err != nil {
+		logger.Log.Error("Error loading api keys from file", zap.Error(err))
+		return err
+	}
+	for _, key := range apiKeys {
+		if err := mapStorage.SaveAPIKey(context.Background(), key); err != nil {
+			return err
+		}
+	}
+
+	records, err := fileStorage.LoadIdempotencyRecords(time.Now())
+	if err != nil {
+		logger.Log.Error("Error loading idempotency records from file", zap.Error(err))
+		return err
+	}
+	for _, record := range records {
+		if err := mapStorage.CompleteIdempotencyKey(context.Background(), record); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -86,18 +386,59 @@ func createRouter(shortener *handlers.URLShortener, cfg *config.Config) chi.Rout
 	r := chi.NewRouter()
 
 	// Промежуточное ПО (middleware) для логирования. перед каждым запросом будет выполнена функция logger.LoggerMiddleware
+	// id запроса нужен всем следующим middleware, поэтому первым
+	r.Use(logger.RequestIDMiddleware)
+	r.Use(tracing.Middleware)
 	r.Use(logger.LoggerMiddleware)
+	r.Use(metrics.Middleware)
 	r.Use(logger.RecoveryMiddleware)
 	// middleware проверяет поддержку сжатия gzip
 	r.Use(handlers.GzipMiddleware)
 
-	r.Post("/", shortener.ShortenURLHandler)
 	r.Get("/{id}", shortener.RedirectURLHandler)
-	r.Post("/api/shorten", shortener.APIShortenerURL)
+	r.Get("/healthz", shortener.HealthzHandler)
+	r.Get("/readyz", shortener.ReadyzHandler)
+	// /ping — прежнее имя /readyz
 	r.Get("/ping", shortener.CheckDBConnect)
-	r.Post("/api/shorten/batch", shortener.BatchShortenURLHandler)
-	r.Get("/api/user/urls", shortener.GetAllURLByUserID)
-	r.Delete("/api/user/urls", shortener.DeleteShortenedURLs)
+	// при отдельном адресе метрики не публикуются на основном сервере
+	if cfg.MetricsAddress == "" {
+		r.Handle("/metrics", metrics.Handler())
+	}
+	r.Post("/api/user/login", shortener.LoginHandler)
+	r.Post("/api/user/logout", shortener.LogoutHandler)
+	r.With(shortener.TrustedSubnetMiddleware).Get("/api/internal/stats", shortener.InternalStatsHandler)
 
+	// пользователь без учетных данных создается при первом сокращении
+	r.With(shortener.Authenticate(handlers.ProvisionUser, handlers.ScopeShorten), shortener.IdempotencyMiddleware).Group(func(r chi.Router) {
+		r.Post("/", shortener.ShortenURLHandler)
+		r.Post("/api/shorten", shortener.APIShortenerURL)
+		r.Post("/api/shorten/batch", shortener.BatchShortenURLHandler)
+	})
+	r.With(shortener.Authenticate(handlers.ProvisionUser, handlers.ScopeAccount)).
+		Post("/api/user/register", shortener.RegisterHandler)
+
+	// остальные операции доступны только существующему пользователю
+	r.With(shortener.Authenticate(handlers.RequireUser, handlers.ScopeRead)).Group(func(r chi.Router) {
+		r.Get("/api/user/urls", shortener.GetAllURLByUserID)
+		r.Get("/api/user/urls/{id}/stats", shortener.ClickStatsHandler)
+	})
+	r.With(shortener.Authenticate(handlers.RequireUser, handlers.ScopeDelete)).
+		Delete("/api/user/urls", shortener.DeleteShortenedURLs)
+	r.With(shortener.Authenticate(handlers.RequireUser, handlers.ScopeManageKeys)).Group(func(r chi.Router) {
+		r.Post("/api/user/keys", shortener.CreateAPIKeyHandler)
+		r.Get("/api/user/keys", shortener.ListAPIKeysHandler)
+		r.Delete("/api/user/keys/{id}", shortener.RevokeAPIKeyHandler)
+	})
+	r.With(shortener.Authenticate(handlers.RequireUser, handlers.ScopeAccount)).
+		Post("/api/user/password", shortener.ChangePasswordHandler)
+
+	return r
+}
+
+// metricsRouter обработчик отдельного сервера метрик
+func metricsRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(logger.RecoveryMiddleware)
+	r.Handle("/metrics", metrics.Handler())
 	return r
 }
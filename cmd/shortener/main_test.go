@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Tokebay/yandex/config"
 
 	"github.com/Tokebay/yandex/internal/app/handlers"
 	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/Tokebay/yandex/internal/screening"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestURLShortener_shortenURLHandlerV(t *testing.T) {
@@ -64,7 +79,8 @@ func TestURLShortener_shortenURLHandlerV(t *testing.T) {
 			request := httptest.NewRequest(http.MethodPost, "/", requestBody)
 			// создаём новый Recorder
 			w := httptest.NewRecorder()
-			shortener.ShortenURLHandler(w, request)
+			// пользователя создает middleware аутентификации
+			shortener.Authenticate(handlers.ProvisionUser, handlers.ScopeShorten)(http.HandlerFunc(shortener.ShortenURLHandler)).ServeHTTP(w, request)
 
 			res := w.Result()
 			// проверяем статус код
@@ -126,7 +142,8 @@ func TestURLShortener_shortenURLHandler(t *testing.T) {
 			request := httptest.NewRequest(http.MethodPost, "/", requestBody)
 			// создаём новый Recorder
 			w := httptest.NewRecorder()
-			shortener.ShortenURLHandler(w, request)
+			// пользователя создает middleware аутентификации
+			shortener.Authenticate(handlers.ProvisionUser, handlers.ScopeShorten)(http.HandlerFunc(shortener.ShortenURLHandler)).ServeHTTP(w, request)
 
 			res := w.Result()
 			// проверяем статус код
@@ -161,7 +178,7 @@ func TestRedirectURLHandler_redirectURLHandler(t *testing.T) {
 		fileStorage,
 	)
 
-	storage.SaveURL("BpLnfgSfEr", "https://mail.ru/")
+	storage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "BpLnfgSfEr", OriginalURL: "https://mail.ru/"})
 
 	type want struct {
 		statusCode  int
@@ -197,3 +214,1125 @@ func TestRedirectURLHandler_redirectURLHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestURLShortener_customAlias(t *testing.T) {
+	cfg := &config.Config{
+		ServerAddress: "localhost:8080",
+		BaseURL:       "http://localhost:8080",
+	}
+	shortener := handlers.NewURLShortener(cfg, storage.NewMapStorage(), nil)
+
+	tests := []struct {
+		name       string
+		alias      string
+		request    string
+		statusCode int
+		shortURL   string
+	}{
+		{
+			name:       "NewAlias",
+			alias:      "my-link",
+			request:    "https://practicum.yandex.ru/",
+			statusCode: http.StatusCreated,
+			shortURL:   "http://localhost:8080/my-link",
+		},
+		{
+			name:       "AliasTaken",
+			alias:      "my-link",
+			request:    "https://mail.ru/",
+			statusCode: http.StatusConflict,
+		},
+		{
+			name:       "ReservedAlias",
+			alias:      "ping",
+			request:    "https://mail.ru/",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "InvalidAlias",
+			alias:      "my%20link",
+			request:    "https://mail.ru/",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/?custom_alias="+tt.alias, strings.NewReader(tt.request))
+			w := httptest.NewRecorder()
+			// пользователя создает middleware аутентификации
+			shortener.Authenticate(handlers.ProvisionUser, handlers.ScopeShorten)(http.HandlerFunc(shortener.ShortenURLHandler)).ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.statusCode, res.StatusCode)
+			if tt.shortURL != "" {
+				bodyContent, err := io.ReadAll(res.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.shortURL, string(bodyContent))
+			}
+		})
+	}
+}
+
+func TestRedirectURLHandler_expiredURL(t *testing.T) {
+	storage := storage.NewMapStorage()
+	cfg := &config.Config{
+		ServerAddress: "localhost:8080",
+		BaseURL:       "http://localhost:8080",
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+
+	storage.SaveURL(context.Background(), models.ShortenURL{
+		ShortURL:    "expired",
+		OriginalURL: "https://mail.ru/",
+		ExpiresAt:   time.Now().Add(-time.Minute),
+	})
+	storage.SaveURL(context.Background(), models.ShortenURL{
+		ShortURL:    "alive",
+		OriginalURL: "https://ya.ru/",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+
+	tests := []struct {
+		name       string
+		shortURL   string
+		statusCode int
+	}{
+		{name: "Expired", shortURL: "http://localhost:8080/expired", statusCode: http.StatusGone},
+		{name: "NotExpired", shortURL: "http://localhost:8080/alive", statusCode: http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.shortURL, nil)
+			w := httptest.NewRecorder()
+			shortener.RedirectURLHandler(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.statusCode, res.StatusCode)
+		})
+	}
+}
+
+func TestShortenExpiredURLAgain(t *testing.T) {
+	storage := storage.NewMapStorage()
+	cfg := &config.Config{
+		BaseURL:         "http://localhost:8080",
+		SessionLifetime: time.Hour,
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+	r := createRouter(shortener, cfg)
+
+	token, err := handlers.BuildSessionToken(1, time.Hour)
+	assert.NoError(t, err)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w
+	}
+	shorten := func(body string) (int, string) {
+		w := do(http.MethodPost, "/api/shorten", body)
+		var resp models.Response
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return w.Code, strings.TrimPrefix(resp.Result, cfg.BaseURL)
+	}
+
+	status, expired := shorten(`{"url":"https://go.dev","ttl_seconds":1}`)
+	assert.Equal(t, http.StatusCreated, status)
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, http.StatusGone, do(http.MethodGet, expired, "").Code)
+
+	// истекшая ссылка не считается дубликатом: создается новая со своим сроком жизни
+	status, renewed := shorten(`{"url":"https://go.dev","ttl_seconds":3600}`)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.NotEqual(t, expired, renewed)
+	assert.Equal(t, http.StatusTemporaryRedirect, do(http.MethodGet, renewed, "").Code)
+
+	status, again := shorten(`{"url":"https://go.dev"}`)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, renewed, again)
+
+	var urls []models.UserURL
+	assert.NoError(t, json.NewDecoder(do(http.MethodGet, "/api/user/urls", "").Body).Decode(&urls))
+	if assert.Len(t, urls, 2) {
+		for _, url := range urls {
+			assert.NotNil(t, url.ExpiresAt)
+		}
+	}
+}
+
+func TestFileStorageRestore(t *testing.T) {
+	cfg := &config.Config{
+		BaseURL:         "http://localhost:8080",
+		FileStoragePath: filepath.Join(t.TempDir(), "short-url-db.json"),
+		SessionLifetime: time.Hour,
+		IdempotencyTTL:  time.Hour,
+	}
+	// start поднимает сервис поверх файла, как при запуске в режиме файлового хранилища
+	start := func() (*handlers.URLShortener, *handlers.Producer, http.Handler) {
+		fileStorage, err := handlers.NewProducer(cfg.FileStoragePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapStorage := storage.NewMapStorage()
+		assert.NoError(t, loadFileStorage(fileStorage, mapStorage))
+		shortener := handlers.NewURLShortener(cfg, mapStorage, fileStorage)
+		return shortener, fileStorage, createRouter(shortener, cfg)
+	}
+	do := func(r http.Handler, method, target, body string, session *http.Cookie) *http.Response {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if session != nil {
+			request.AddCookie(session)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w.Result()
+	}
+	shorten := func(r http.Handler, originalURL string, session *http.Cookie) (string, *http.Cookie) {
+		res := do(r, http.MethodPost, "/", originalURL, session)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusCreated, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		for _, c := range res.Cookies() {
+			if c.Name == handlers.CookieName {
+				session = c
+			}
+		}
+		return strings.TrimPrefix(string(body), cfg.BaseURL+"/"), session
+	}
+
+	shortener, fileStorage, r := start()
+	deleted, owner := shorten(r, "https://mail.ru/", nil)
+	kept, _ := shorten(r, "https://ya.ru/", owner)
+	res := do(r, http.MethodDelete, "/api/user/urls", `["`+deleted+`"]`, owner)
+	res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	shortener.StopDeleteWorkers()
+	idempotent := func(r http.Handler) *http.Response {
+		request := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://go.dev"}`))
+		request.AddCookie(owner)
+		request.Header.Set(handlers.IdempotencyKeyHeader, "restart")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w.Result()
+	}
+	res = idempotent(r)
+	firstBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	// анонимный пользователь без ссылок
+	withoutURLs, _, err := shortener.NewAnonymousUser(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, fileStorage.Close())
+
+	shortener, fileStorage, r = start()
+	defer fileStorage.Close()
+	defer shortener.StopDeleteWorkers()
+
+	res = do(r, http.MethodGet, "/"+deleted, "", nil)
+	res.Body.Close()
+	assert.Equal(t, http.StatusGone, res.StatusCode)
+
+	res = do(r, http.MethodGet, "/api/user/urls", "", owner)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var urls []models.UserURL
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&urls))
+	if assert.Len(t, urls, 2) {
+		assert.Contains(t, []string{urls[0].ShortURL, urls[1].ShortURL}, cfg.BaseURL+"/"+kept)
+	}
+
+	// ответ на запрос с Idempotency-Key повторяется и после перезапуска
+	res = idempotent(r)
+	replayedBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "true", res.Header.Get(handlers.IdempotentReplayedHeader))
+	assert.Equal(t, firstBody, replayedBody)
+
+	// идентификатор пользователя без ссылок не выдается повторно
+	identity, _, err := shortener.NewAnonymousUser(context.Background())
+	assert.NoError(t, err)
+	assert.Greater(t, identity.UserID, withoutURLs.UserID)
+}
+
+func TestClickStatsHandler(t *testing.T) {
+	storage := storage.NewMapStorage()
+	cfg := &config.Config{
+		ServerAddress: "localhost:8080",
+		BaseURL:       "http://localhost:8080",
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+	r := createRouter(shortener, cfg)
+
+	storage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "stats", OriginalURL: "https://mail.ru/", UserID: 1})
+
+	for _, referrer := range []string{"https://ya.ru/", "https://ya.ru/", "https://go.dev/"} {
+		request := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		request.Header.Set("Referer", referrer)
+		request.Header.Set("X-Real-IP", "192.168.1.42")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	}
+	// дожидаемся записи буфера переходов
+	shortener.StopClickRecorder()
+
+	ownerToken, err := handlers.BuildJWTString(1)
+	assert.NoError(t, err)
+	otherToken, err := handlers.BuildJWTString(2)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		token      string
+		statusCode int
+	}{
+		{name: "Owner", token: ownerToken, statusCode: http.StatusOK},
+		{name: "OtherUser", token: otherToken, statusCode: http.StatusNotFound},
+		{name: "NoCookie", statusCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls/stats/stats", nil)
+			if tt.token != "" {
+				request.AddCookie(&http.Cookie{Name: handlers.CookieName, Value: tt.token})
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.statusCode, res.StatusCode)
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			var stats models.ClickStats
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+			assert.Equal(t, "http://localhost:8080/stats", stats.ShortURL)
+			assert.Equal(t, 3, stats.Total)
+			assert.Equal(t, []models.DailyClicks{{Date: time.Now().UTC().Format("2006-01-02"), Clicks: 3}}, stats.Daily)
+			assert.Equal(t, []models.ReferrerClicks{
+				{Referrer: "https://ya.ru/", Clicks: 2},
+				{Referrer: "https://go.dev/", Clicks: 1},
+			}, stats.TopReferrers)
+		})
+	}
+}
+
+func TestDeleteShortenedURLs(t *testing.T) {
+	storage := storage.NewMapStorage()
+	cfg := &config.Config{
+		ServerAddress: "localhost:8080",
+		BaseURL:       "http://localhost:8080",
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+	r := createRouter(shortener, cfg)
+
+	storage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "own", OriginalURL: "https://mail.ru/", UserID: 1})
+	storage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "foreign", OriginalURL: "https://ya.ru/", UserID: 2})
+
+	token, err := handlers.BuildJWTString(1)
+	assert.NoError(t, err)
+	request := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["own", "foreign"]`))
+	request.AddCookie(&http.Cookie{Name: handlers.CookieName, Value: token})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	// дожидаемся обработки очереди удаления
+	shortener.StopDeleteWorkers()
+
+	tests := []struct {
+		shortURL   string
+		statusCode int
+	}{
+		{shortURL: "/own", statusCode: http.StatusGone},
+		{shortURL: "/foreign", statusCode: http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.shortURL, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.shortURL, nil))
+			assert.Equal(t, tt.statusCode, w.Code)
+		})
+	}
+
+	// удаленная ссылка не считается дубликатом, тот же URL сокращается заново
+	request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://mail.ru/"))
+	request.AddCookie(&http.Cookie{Name: handlers.CookieName, Value: token})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NotEqual(t, "http://localhost:8080/own", w.Body.String())
+
+	// после остановки новые запросы на удаление не принимаются
+	request = httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["foreign"]`))
+	request.AddCookie(&http.Cookie{Name: handlers.CookieName, Value: token})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestSessionRenewal(t *testing.T) {
+	storage := storage.NewMapStorage()
+	cfg := &config.Config{
+		ServerAddress:      "localhost:8080",
+		BaseURL:            "http://localhost:8080",
+		SessionLifetime:    time.Hour,
+		SessionGracePeriod: time.Hour,
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+	r := createRouter(shortener, cfg)
+
+	storage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "sess", OriginalURL: "https://mail.ru/", UserID: 1})
+
+	fresh, err := handlers.BuildSessionToken(1, time.Hour)
+	assert.NoError(t, err)
+	// прошло больше половины срока жизни
+	aging, err := handlers.BuildSessionToken(1, 20*time.Minute)
+	assert.NoError(t, err)
+	recentlyExpired, err := handlers.BuildSessionToken(1, -30*time.Minute)
+	assert.NoError(t, err)
+	longExpired, err := handlers.BuildSessionToken(1, -2*time.Hour)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		token      string
+		statusCode int
+		renewed    bool
+		errorCode  string
+	}{
+		{name: "Fresh", token: fresh, statusCode: http.StatusOK},
+		{name: "PastHalfLifetime", token: aging, statusCode: http.StatusOK, renewed: true},
+		{name: "RecentlyExpired", token: recentlyExpired, statusCode: http.StatusOK, renewed: true},
+		{name: "LongExpired", token: longExpired, statusCode: http.StatusUnauthorized, errorCode: handlers.AuthErrorExpired},
+		{name: "Invalid", token: "garbage", statusCode: http.StatusUnauthorized, errorCode: handlers.AuthErrorInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+			request.AddCookie(&http.Cookie{Name: handlers.CookieName, Value: tt.token})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.statusCode, res.StatusCode)
+
+			var renewedToken string
+			for _, c := range res.Cookies() {
+				if c.Name == handlers.CookieName {
+					renewedToken = c.Value
+				}
+			}
+			assert.Equal(t, tt.renewed, renewedToken != "")
+			if tt.renewed {
+				userID, err := handlers.ExtractUserIDFromToken(renewedToken)
+				assert.NoError(t, err)
+				assert.Equal(t, 1, userID)
+			}
+
+			if tt.errorCode != "" {
+				var errResp models.ErrorResponse
+				assert.NoError(t, json.NewDecoder(res.Body).Decode(&errResp))
+				assert.Equal(t, tt.errorCode, errResp.Code)
+			}
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	storage := storage.NewMapStorage()
+	cfg := &config.Config{
+		ServerAddress:   "localhost:8080",
+		BaseURL:         "http://localhost:8080",
+		SessionLifetime: time.Hour,
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+	r := createRouter(shortener, cfg)
+
+	token, err := handlers.BuildSessionToken(1, time.Hour)
+	assert.NoError(t, err)
+
+	do := func(method, target, body, authorization string) *http.Response {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	res := do(http.MethodPost, "/api/user/keys", `{"name":"ci","scopes":["shorten","read"]}`, "Bearer "+token)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var created models.APIKeyResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&created))
+	assert.True(t, strings.HasPrefix(created.Key, handlers.APIKeyPrefix))
+	assert.Equal(t, []string{"shorten", "read"}, created.Scopes)
+	apiKey := "Bearer " + created.Key
+
+	// без scopes ключ получает все права
+	res = do(http.MethodPost, "/api/user/keys", `{"name":"all"}`, "Bearer "+token)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var allScopes models.APIKeyResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&allScopes))
+	assert.Equal(t, []string{"shorten", "read", "delete"}, allScopes.Scopes)
+
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		body          string
+		authorization string
+		statusCode    int
+	}{
+		{name: "UnknownScope", method: http.MethodPost, target: "/api/user/keys", body: `{"scopes":["admin"]}`, authorization: "Bearer " + token, statusCode: http.StatusBadRequest},
+		{name: "ShortenWithKey", method: http.MethodPost, target: "/api/shorten", body: `{"url":"https://practicum.yandex.ru"}`, authorization: apiKey, statusCode: http.StatusCreated},
+		{name: "ReadWithKey", method: http.MethodGet, target: "/api/user/urls", authorization: apiKey, statusCode: http.StatusOK},
+		{name: "DeleteWithoutScope", method: http.MethodDelete, target: "/api/user/urls", body: `[]`, authorization: apiKey, statusCode: http.StatusForbidden},
+		{name: "KeyCannotManageKeys", method: http.MethodGet, target: "/api/user/keys", authorization: apiKey, statusCode: http.StatusForbidden},
+		{name: "ListWithToken", method: http.MethodGet, target: "/api/user/keys", authorization: "Bearer " + token, statusCode: http.StatusOK},
+		{name: "UnknownKey", method: http.MethodGet, target: "/api/user/urls", authorization: "Bearer sk_unknown", statusCode: http.StatusUnauthorized},
+		{name: "NotBearer", method: http.MethodGet, target: "/api/user/urls", authorization: "Basic dXNlcg==", statusCode: http.StatusUnauthorized},
+		{name: "Revoke", method: http.MethodDelete, target: "/api/user/keys/" + created.ID, authorization: "Bearer " + token, statusCode: http.StatusNoContent},
+		{name: "RevokedKey", method: http.MethodGet, target: "/api/user/urls", authorization: apiKey, statusCode: http.StatusUnauthorized},
+		{name: "RevokeAgain", method: http.MethodDelete, target: "/api/user/keys/" + created.ID, authorization: "Bearer " + token, statusCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := do(tt.method, tt.target, tt.body, tt.authorization)
+			defer res.Body.Close()
+			assert.Equal(t, tt.statusCode, res.StatusCode)
+		})
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	storage := storage.NewMapStorage()
+	cfg := &config.Config{
+		ServerAddress:      "localhost:8080",
+		BaseURL:            "http://localhost:8080",
+		SessionLifetime:    time.Hour,
+		SessionGracePeriod: time.Hour,
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+	r := createRouter(shortener, cfg)
+
+	// do выполняет запрос и возвращает ответ и cookie сессии из ответа, если она была выдана
+	do := func(method, target, body string, session *http.Cookie) (*http.Response, *http.Cookie) {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if session != nil {
+			request.AddCookie(session)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		res := w.Result()
+		for _, c := range res.Cookies() {
+			if c.Name == handlers.CookieName {
+				return res, c
+			}
+		}
+		return res, session
+	}
+	userURLs := func(session *http.Cookie) []models.UserURL {
+		res, _ := do(http.MethodGet, "/api/user/urls", "", session)
+		defer res.Body.Close()
+		var urls []models.UserURL
+		if res.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&urls))
+		}
+		return urls
+	}
+
+	// анонимный пользователь сокращает ссылку и регистрируется, сохраняя ее
+	res, anonymous := do(http.MethodPost, "/api/shorten", `{"url":"https://practicum.yandex.ru"}`, nil)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, account := do(http.MethodPost, "/api/user/register", `{"email":"User@Example.com","password":"secret-password"}`, anonymous)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var registered models.UserResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&registered))
+	assert.Equal(t, "user@example.com", registered.Email)
+	assert.Len(t, userURLs(account), 1)
+
+	res, _ = do(http.MethodPost, "/api/user/register", `{"email":"user@example.com","password":"another-password"}`, nil)
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	res, _ = do(http.MethodPost, "/api/user/register", `{"email":"other@example.com","password":"short"}`, nil)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// ссылки нового анонимного пользователя переходят к учетной записи при входе
+	res, anonymous = do(http.MethodPost, "/api/shorten", `{"url":"https://go.dev"}`, nil)
+	res.Body.Close()
+	res, account = do(http.MethodPost, "/api/user/login", `{"email":"user@example.com","password":"secret-password"}`, anonymous)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Len(t, userURLs(account), 2)
+
+	// токен, истекший дольше SessionGracePeriod назад, не передает ссылки, истекший недавно — передает
+	res, anonymous = do(http.MethodPost, "/api/shorten", `{"url":"https://go.dev/doc"}`, nil)
+	res.Body.Close()
+	anonymousID, err := handlers.ExtractUserIDFromToken(anonymous.Value)
+	assert.NoError(t, err)
+	longExpired, err := handlers.BuildSessionToken(anonymousID, -2*time.Hour)
+	assert.NoError(t, err)
+	res, account = do(http.MethodPost, "/api/user/login", `{"email":"user@example.com","password":"secret-password"}`,
+		&http.Cookie{Name: handlers.CookieName, Value: longExpired})
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Len(t, userURLs(account), 2)
+	assert.Len(t, userURLs(anonymous), 1)
+
+	recentlyExpired, err := handlers.BuildSessionToken(anonymousID, -30*time.Minute)
+	assert.NoError(t, err)
+	res, account = do(http.MethodPost, "/api/user/login", `{"email":"user@example.com","password":"secret-password"}`,
+		&http.Cookie{Name: handlers.CookieName, Value: recentlyExpired})
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Len(t, userURLs(account), 3)
+
+	res, _ = do(http.MethodPost, "/api/user/login", `{"email":"user@example.com","password":"wrong-password"}`, nil)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	var errResp models.ErrorResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&errResp))
+	assert.Equal(t, handlers.AuthErrorCredentials, errResp.Code)
+
+	res, _ = do(http.MethodPost, "/api/user/password", `{"old_password":"wrong-password","new_password":"new-password"}`, account)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res, _ = do(http.MethodPost, "/api/user/password", `{"old_password":"secret-password","new_password":"new-password"}`, account)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = do(http.MethodPost, "/api/user/login", `{"email":"user@example.com","password":"new-password"}`, nil)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, loggedOut := do(http.MethodPost, "/api/user/logout", "", account)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Less(t, loggedOut.MaxAge, 0)
+}
+
+func TestInternalStats(t *testing.T) {
+	storage := storage.NewMapStorage()
+	ctx := context.Background()
+	storage.SaveURL(ctx, models.ShortenURL{ShortURL: "active", OriginalURL: "https://ya.ru/", UserID: 1})
+	storage.SaveURL(ctx, models.ShortenURL{ShortURL: "deleted", OriginalURL: "https://go.dev/", UserID: 1, DeletedFlag: true})
+	storage.SaveURL(ctx, models.ShortenURL{ShortURL: "expired", OriginalURL: "https://mail.ru/", UserID: 2,
+		ExpiresAt: time.Now().Add(-time.Hour)})
+
+	tests := []struct {
+		name       string
+		subnet     string
+		realIP     string
+		statusCode int
+	}{
+		{name: "TrustedIP", subnet: "10.0.0.0/8", realIP: "10.1.2.3", statusCode: http.StatusOK},
+		{name: "UntrustedIP", subnet: "10.0.0.0/8", realIP: "192.168.1.1", statusCode: http.StatusForbidden},
+		{name: "NoRealIP", subnet: "10.0.0.0/8", statusCode: http.StatusForbidden},
+		{name: "EmptySubnet", realIP: "10.1.2.3", statusCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				BaseURL:       "http://localhost:8080",
+				TrustedSubnet: tt.subnet,
+			}
+			shortener := handlers.NewURLShortener(cfg, storage, nil)
+			defer shortener.StopDeleteWorkers()
+			r := createRouter(shortener, cfg)
+
+			request := httptest.NewRequest(http.MethodGet, "/api/internal/stats", nil)
+			if tt.realIP != "" {
+				request.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.statusCode, res.StatusCode)
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+
+			var stats models.Stats
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+			assert.Equal(t, models.Stats{URLs: 3, Users: 2, Deleted: 1, Expired: 1}, stats)
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := &config.Config{
+		ServerAddress: "localhost:8080",
+		BaseURL:       "http://localhost:8080",
+	}
+	shortener := handlers.NewURLShortener(cfg, storage.NewInstrumentedStorage(storage.NewMapStorage(), "memory"), nil)
+	defer shortener.StopDeleteWorkers()
+	r := createRouter(shortener, cfg)
+
+	for _, path := range []string{"/missing", "/api/unknown/path"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	res := w.Result()
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	// метки — шаблон маршрута, а не путь запроса
+	assert.Contains(t, string(body), `shortener_http_requests_total{method="GET",route="/{id}",status="400"}`)
+	assert.Contains(t, string(body), `route="not_found"`)
+	assert.NotContains(t, string(body), `/missing`)
+	assert.Contains(t, string(body), `shortener_storage_operation_duration_seconds_count{backend="memory",operation="get_url"}`)
+	// ненайденная ссылка — не сбой хранилища
+	assert.NotContains(t, string(body), `shortener_storage_operation_errors_total{backend="memory",operation="get_url"}`)
+
+	// с отдельным адресом метрики на основном сервере не отдаются
+	cfg.MetricsAddress = "localhost:9090"
+	w = httptest.NewRecorder()
+	createRouter(shortener, cfg).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.NotContains(t, w.Body.String(), "shortener_http_requests_total")
+}
+
+func TestHealthProbes(t *testing.T) {
+	cfg := &config.Config{
+		BaseURL:         "http://localhost:8080",
+		FileStoragePath: t.TempDir() + "/short-url-db.json",
+	}
+	fileStorage, err := handlers.NewProducer(cfg.FileStoragePath)
+	assert.NoError(t, err)
+	defer fileStorage.Close()
+	shortener := handlers.NewURLShortener(cfg, storage.NewMapStorage(), fileStorage)
+	defer shortener.StopDeleteWorkers()
+	r := createRouter(shortener, cfg)
+
+	probe := func(path string) (int, models.HealthResponse) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp models.HealthResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return w.Code, resp
+	}
+
+	code, resp := probe("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, models.HealthStatusOK, resp.Status)
+
+	code, resp = probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, models.HealthResponse{
+		Status: models.HealthStatusOK,
+		Components: map[string]models.ComponentStatus{
+			"storage":      {Status: models.HealthStatusOK},
+			"file_storage": {Status: models.HealthStatusOK},
+		},
+	}, resp)
+
+	// файл журнала удален — сервис жив, но не готов
+	assert.NoError(t, os.Remove(cfg.FileStoragePath))
+	code, _ = probe("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, resp = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, models.HealthStatusUnavailable, resp.Status)
+	assert.Equal(t, models.HealthStatusUnavailable, resp.Components["file_storage"].Status)
+	assert.Equal(t, models.HealthStatusOK, resp.Components["storage"].Status)
+
+	// /ping сохраняет прежний код ошибки
+	code, resp = probe("/ping")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Equal(t, models.HealthStatusUnavailable, resp.Status)
+}
+
+func TestRequestID(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	defaultLog := logger.Log
+	logger.Log = zap.New(core)
+	defer func() { logger.Log = defaultLog }()
+
+	storage := storage.NewMapStorage()
+	storage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "traced", OriginalURL: "https://ya.ru/", UserID: 1})
+	cfg := &config.Config{
+		BaseURL:             "http://localhost:8080",
+		DeleteFlushInterval: 10 * time.Millisecond,
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+	r := createRouter(shortener, cfg)
+
+	tests := []struct {
+		name      string
+		requestID string
+		generated bool
+	}{
+		{name: "FromClient", requestID: "req-42"},
+		{name: "Generated", generated: true},
+		{name: "InvalidReplaced", requestID: "bad id\nforged log line", generated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+			if tt.requestID != "" {
+				request.Header.Set(logger.RequestIDHeader, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			requestID := w.Header().Get(logger.RequestIDHeader)
+			assert.NotEmpty(t, requestID)
+			if tt.generated {
+				assert.NotEqual(t, tt.requestID, requestID)
+			} else {
+				assert.Equal(t, tt.requestID, requestID)
+			}
+		})
+	}
+
+	// удаление выполняется асинхронно, но в логах остается id запроса, который его поставил
+	token, err := handlers.BuildJWTString(1)
+	assert.NoError(t, err)
+	request := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["traced"]`))
+	request.Header.Set(logger.RequestIDHeader, "delete-1")
+	request.AddCookie(&http.Cookie{Name: handlers.CookieName, Value: token})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	shortener.StopDeleteWorkers()
+
+	handled := logs.FilterMessage("Request handled").FilterField(zap.String("request_id", "delete-1"))
+	assert.Equal(t, 1, handled.Len())
+	deleted := logs.FilterMessage("URLs marked as deleted").FilterField(zap.Strings("request_ids", []string{"delete-1"}))
+	assert.Equal(t, 1, deleted.Len())
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defaultProvider, defaultPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(defaultProvider)
+		otel.SetTextMapPropagator(defaultPropagator)
+	}()
+
+	urlStorage := storage.NewInstrumentedStorage(storage.NewMapStorage(), "memory")
+	urlStorage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "traced", OriginalURL: "https://ya.ru/", UserID: 1})
+	cfg := &config.Config{
+		BaseURL:             "http://localhost:8080",
+		DeleteFlushInterval: 10 * time.Millisecond,
+	}
+	shortener := handlers.NewURLShortener(cfg, urlStorage, nil)
+	r := createRouter(shortener, cfg)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	request := httptest.NewRequest(http.MethodGet, "/traced", nil)
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+
+	// удаление выполняется в отдельной трассе, связанной с трассой запроса
+	token, err := handlers.BuildJWTString(1)
+	assert.NoError(t, err)
+	request = httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["traced"]`))
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	request.AddCookie(&http.Cookie{Name: handlers.CookieName, Value: token})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	shortener.StopDeleteWorkers()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	redirect, ok := spans["GET /{id}"]
+	if assert.True(t, ok) {
+		assert.Equal(t, traceID, redirect.SpanContext().TraceID().String())
+	}
+	getURL, ok := spans["storage.get_url"]
+	if assert.True(t, ok) && redirect != nil {
+		assert.Equal(t, redirect.SpanContext().SpanID(), getURL.Parent().SpanID())
+	}
+	batch, ok := spans["delete_batch"]
+	if assert.True(t, ok) {
+		assert.NotEqual(t, traceID, batch.SpanContext().TraceID().String())
+		if assert.Len(t, batch.Links(), 1) {
+			assert.Equal(t, traceID, batch.Links()[0].SpanContext.TraceID().String())
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	storage := storage.NewMapStorage()
+	cfg := &config.Config{
+		ServerAddress:   "localhost:8080",
+		BaseURL:         "http://localhost:8080",
+		SessionLifetime: time.Hour,
+		IdempotencyTTL:  time.Hour,
+	}
+	shortener := handlers.NewURLShortener(cfg, storage, nil)
+	r := createRouter(shortener, cfg)
+
+	firstUser, err := handlers.BuildSessionToken(1, time.Hour)
+	assert.NoError(t, err)
+	secondUser, err := handlers.BuildSessionToken(2, time.Hour)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		key        string
+		token      string
+		statusCode int
+		replayed   bool
+		sameAs     string // имя теста с тем же телом ответа
+	}{
+		{name: "First", target: "/api/shorten", body: `{"url":"https://go.dev"}`, key: "shorten-1", token: firstUser, statusCode: http.StatusCreated},
+		{name: "Retry", target: "/api/shorten", body: `{"url":"https://go.dev"}`, key: "shorten-1", token: firstUser, statusCode: http.StatusCreated, replayed: true, sameAs: "First"},
+		{name: "DifferentBody", target: "/api/shorten", body: `{"url":"https://pkg.go.dev"}`, key: "shorten-1", token: firstUser, statusCode: http.StatusUnprocessableEntity},
+		{name: "DifferentPath", target: "/", body: "https://go.dev", key: "shorten-1", token: firstUser, statusCode: http.StatusUnprocessableEntity},
+		{name: "OtherUser", target: "/api/shorten", body: `{"url":"https://go.dev"}`, key: "shorten-1", token: secondUser, statusCode: http.StatusConflict},
+		{name: "Batch", target: "/api/shorten/batch", body: `[{"correlation_id":"1","original_url":"https://go.dev/doc"}]`, key: "batch-1", token: firstUser, statusCode: http.StatusCreated},
+		{name: "BatchRetry", target: "/api/shorten/batch", body: `[{"correlation_id":"1","original_url":"https://go.dev/doc"}]`, key: "batch-1", token: firstUser, statusCode: http.StatusCreated, replayed: true, sameAs: "Batch"},
+		{name: "InvalidKey", target: "/", body: "https://go.dev/blog", key: "ключ", token: firstUser, statusCode: http.StatusBadRequest},
+		{name: "WithoutKey", target: "/", body: "https://go.dev/blog", token: firstUser, statusCode: http.StatusCreated},
+	}
+	bodies := make(map[string]string)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+			if tt.key != "" {
+				request.Header.Set(handlers.IdempotencyKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, tt.replayed, w.Header().Get(handlers.IdempotentReplayedHeader) == "true")
+			bodies[tt.name] = w.Body.String()
+			if tt.sameAs != "" {
+				assert.Equal(t, bodies[tt.sameAs], w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDedupScope(t *testing.T) {
+	firstUser, err := handlers.BuildSessionToken(1, time.Hour)
+	assert.NoError(t, err)
+	secondUser, err := handlers.BuildSessionToken(2, time.Hour)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		scope storage.DedupScope
+		// статусы повторного сокращения тем же и другим пользователем
+		sameUserStatus  int
+		otherUserStatus int
+		otherUserLink   bool // у второго пользователя своя ссылка
+	}{
+		{scope: storage.DedupGlobal, sameUserStatus: http.StatusConflict, otherUserStatus: http.StatusConflict},
+		{scope: storage.DedupUser, sameUserStatus: http.StatusConflict, otherUserStatus: http.StatusCreated, otherUserLink: true},
+		{scope: storage.DedupNone, sameUserStatus: http.StatusCreated, otherUserStatus: http.StatusCreated, otherUserLink: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.scope), func(t *testing.T) {
+			urlStorage := storage.NewMapStorage()
+			urlStorage.SetDedupScope(tt.scope)
+			cfg := &config.Config{
+				BaseURL:         "http://localhost:8080",
+				SessionLifetime: time.Hour,
+			}
+			shortener := handlers.NewURLShortener(cfg, urlStorage, nil)
+			r := createRouter(shortener, cfg)
+
+			do := func(method, target, body, token string) *httptest.ResponseRecorder {
+				request := httptest.NewRequest(method, target, strings.NewReader(body))
+				request.Header.Set("Authorization", "Bearer "+token)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, request)
+				return w
+			}
+
+			first := do(http.MethodPost, "/", "https://go.dev", firstUser)
+			assert.Equal(t, http.StatusCreated, first.Code)
+
+			again := do(http.MethodPost, "/", "https://go.dev", firstUser)
+			assert.Equal(t, tt.sameUserStatus, again.Code)
+			assert.Equal(t, tt.sameUserStatus == http.StatusConflict, first.Body.String() == again.Body.String())
+
+			other := do(http.MethodPost, "/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://go.dev"}]`, secondUser)
+			assert.Equal(t, tt.otherUserStatus, other.Code)
+			assert.Equal(t, tt.otherUserLink, !strings.Contains(other.Body.String(), first.Body.String()))
+
+			list := do(http.MethodGet, "/api/user/urls", "", secondUser)
+			if tt.otherUserLink {
+				assert.Equal(t, http.StatusOK, list.Code)
+			} else {
+				assert.Equal(t, http.StatusNoContent, list.Code)
+			}
+		})
+	}
+}
+
+func TestURLValidation(t *testing.T) {
+	urlStorage := storage.NewMapStorage()
+	urlStorage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "legacy", OriginalURL: "javascript:alert(1)", UserID: 1})
+	cfg := &config.Config{
+		BaseURL:         "http://localhost:8080",
+		SessionLifetime: time.Hour,
+		MaxURLLength:    64,
+	}
+	shortener := handlers.NewURLShortener(cfg, urlStorage, nil)
+	shortener.SetGenerateIDFunc(func() string { return "EwHXdJfB" })
+	r := createRouter(shortener, cfg)
+
+	token, err := handlers.BuildSessionToken(1, time.Hour)
+	assert.NoError(t, err)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		statusCode int
+	}{
+		{name: "Empty", target: "/", body: "", statusCode: http.StatusBadRequest},
+		{name: "JavaScript", target: "/", body: "javascript:alert(1)", statusCode: http.StatusBadRequest},
+		{name: "Relative", target: "/api/shorten", body: `{"url":"go.dev"}`, statusCode: http.StatusBadRequest},
+		{name: "TooLong", target: "/api/shorten", body: `{"url":"https://go.dev/` + strings.Repeat("a", 64) + `"}`, statusCode: http.StatusBadRequest},
+		{name: "Normalized", target: "/", body: "HTTPS://Go.Dev:443/doc\n", statusCode: http.StatusCreated},
+		// тот же URL после нормализации
+		{name: "Duplicate", target: "/api/shorten", body: `{"url":"https://go.dev/doc"}`, statusCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.statusCode, do(http.MethodPost, tt.target, tt.body).Code)
+		})
+	}
+
+	w := do(http.MethodGet, "/EwHXdJfB", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "https://go.dev/doc", w.Header().Get("Location"))
+
+	// сохраненные до проверки ссылки не на http(s) не открываются
+	assert.Equal(t, http.StatusGone, do(http.MethodGet, "/legacy", "").Code)
+
+	// в ответе на пачку ошибки всех неверных элементов, ничего не сохраняется
+	w = do(http.MethodPost, "/api/shorten/batch", `[
+		{"correlation_id":"1","original_url":"https://go.dev/blog"},
+		{"correlation_id":"2","original_url":"ftp://go.dev"},
+		{"correlation_id":"3","original_url":"https://go.dev/play","custom_alias":"a"}
+	]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var resp models.BatchErrorResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, handlers.ValidationErrorBatch, resp.Code)
+	if assert.Len(t, resp.Errors, 2) {
+		assert.Equal(t, "2", resp.Errors[0].CorrelationID)
+		assert.Equal(t, handlers.ValidationErrorURL, resp.Errors[0].Code)
+		assert.Equal(t, "3", resp.Errors[1].CorrelationID)
+		assert.Equal(t, handlers.ValidationErrorAlias, resp.Errors[1].Code)
+	}
+	_, err = urlStorage.GetShortURL(context.Background(), 1, "https://go.dev/blog")
+	assert.ErrorIs(t, err, storage.ErrURLNotFound)
+}
+
+func TestScreening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("evil.example\n"), 0600))
+	blocklist, err := screening.LoadBlocklist(path)
+	assert.NoError(t, err)
+	lookup := screening.NewFakeLookup()
+	lookup.Block("phishing.test", "phishing")
+
+	urlStorage := storage.NewMapStorage()
+	// ссылка сохранена до того, как домен заблокировали
+	urlStorage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "before", OriginalURL: "https://login.evil.example/", UserID: 1})
+	cfg := &config.Config{
+		BaseURL:         "http://localhost:8080",
+		SessionLifetime: time.Hour,
+	}
+	shortener := handlers.NewURLShortener(cfg, urlStorage, nil)
+	shortener.SetScreener(screening.New(blocklist, lookup))
+	r := createRouter(shortener, cfg)
+
+	token, err := handlers.BuildSessionToken(1, time.Hour)
+	assert.NoError(t, err)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		statusCode int
+	}{
+		{name: "BlockedDomain", method: http.MethodPost, target: "/", body: "https://www.evil.example/", statusCode: http.StatusUnprocessableEntity},
+		{name: "BlockedByLookup", method: http.MethodPost, target: "/api/shorten", body: `{"url":"https://phishing.test/login"}`, statusCode: http.StatusUnprocessableEntity},
+		{name: "Allowed", method: http.MethodPost, target: "/api/shorten", body: `{"url":"https://go.dev"}`, statusCode: http.StatusCreated},
+		{name: "BlockedBatch", method: http.MethodPost, target: "/api/shorten/batch", body: `[
+			{"correlation_id":"1","original_url":"https://go.dev/doc"},
+			{"correlation_id":"2","original_url":"https://phishing.test/"}
+		]`, statusCode: http.StatusUnprocessableEntity},
+		{name: "RedirectBlocked", method: http.MethodGet, target: "/before", statusCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(tt.method, tt.target, tt.body)
+			assert.Equal(t, tt.statusCode, w.Code)
+			if tt.name == "BlockedBatch" {
+				var resp models.BatchErrorResponse
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				if assert.Len(t, resp.Errors, 1) {
+					assert.Equal(t, "2", resp.Errors[0].CorrelationID)
+					assert.Equal(t, handlers.ValidationErrorBlocked, resp.Errors[0].Code)
+				}
+			}
+		})
+	}
+	// при переходе внешний сервис не вызывается
+	calls := lookup.Calls()
+	do(http.MethodGet, "/before", "")
+	assert.Equal(t, calls, lookup.Calls())
+
+	// сервис проверки недоступен — сокращение не выполняется
+	lookup.SetError(errors.New("timeout"))
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost, "/", "https://go.dev/blog").Code)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/Tokebay/yandex/config"
+	"github.com/Tokebay/yandex/internal/cert"
+	logger "github.com/Tokebay/yandex/internal/logger"
+	"go.uber.org/zap"
+)
+
+// newTLSConfig загружает сертификат из файлов или, если они не заданы, генерирует самоподписанный
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	var certificate tls.Certificate
+	var err error
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		certificate, err = tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		logger.Log.Warn("TLS certificate is not configured, using self-signed certificate")
+		certificate, err = cert.GenerateSelfSigned(tlsHosts(cfg.ServerAddress))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func tlsHosts(addr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// httpsRedirectHandler перенаправляет HTTP-запросы на тот же путь по HTTPS
+func httpsRedirectHandler(httpsAddr string) http.Handler {
+	_, httpsPort, err := net.SplitHostPort(httpsAddr)
+	if err != nil {
+		logger.Log.Error("Error parsing HTTPS address", zap.Error(err))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
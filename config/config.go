@@ -1,8 +1,21 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
 )
 
 type Config struct {
@@ -11,53 +24,467 @@ type Config struct {
 	ServerPort      string
 	FileStoragePath string
 	DSN             string
-	DataBaseConn    DataBase
+
+	// FileSyncPolicy политика fsync файла хранилища: always, interval или none
+	FileSyncPolicy      string
+	FileCompactInterval time.Duration
+
+	// ExpiredReapInterval как часто удалять истекшие ссылки, ExpiredRetention сколько их хранить после истечения
+	ExpiredReapInterval time.Duration
+	ExpiredRetention    time.Duration
+
+	// MaxURLLength наибольшая длина сокращаемого URL, StripURLFragment убирать ли из него #фрагмент
+	MaxURLLength     int
+	StripURLFragment bool
+
+	// BlocklistFile файл с заблокированными доменами и регулярными выражениями, перечитывается каждые
+	// BlocklistReloadInterval. ScreeningURL адрес внешнего сервиса проверки URL. Пустые — проверка отключена
+	BlocklistFile           string
+	BlocklistReloadInterval time.Duration
+	ScreeningURL            string
+	ScreeningTimeout        time.Duration
+
+	// DedupScope в каких пределах повторное сокращение URL возвращает прежнюю ссылку: global, user или none
+	DedupScope string
+
+	// IdempotencyTTL сколько хранится ответ на запрос с Idempotency-Key. 0 — заголовок не учитывается
+	IdempotencyTTL time.Duration
+
+	// пул фоновых обработчиков удаления URL
+	DeleteWorkers       int
+	DeleteBatchSize     int
+	DeleteFlushInterval time.Duration
+
+	// таймауты HTTP-сервера и время на завершение текущих запросов при остановке
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	// EnableHTTPS без TLSCertFile и TLSKeyFile использует самоподписанный сертификат
+	EnableHTTPS bool
+	TLSCertFile string
+	TLSKeyFile  string
+	// HTTPRedirectAddress адрес HTTP-сервера, перенаправляющего на HTTPS. Пустой — не запускается
+	HTTPRedirectAddress string
+
+	// GRPCAddress адрес gRPC-сервера. Пустой — не запускается
+	GRPCAddress string
+
+	// MetricsAddress адрес отдельного HTTP-сервера для /metrics. Пустой — метрики отдаются основным сервером
+	MetricsAddress string
+
+	// TracingExporter куда отправлять трассировку: none, stdout, file (TracingFile) или otlp (OTLP/gRPC на TracingEndpoint)
+	TracingExporter string
+	TracingFile     string
+	TracingEndpoint string
+	TracingInsecure bool
+
+	// TrustedSubnet CIDR, из которого доступна внутренняя статистика. Пустой — статистика недоступна никому
+	TrustedSubnet string
+
+	// JWTSecret активный секрет HS256, JWTKeyID его kid в заголовке токена.
+	// Для EdDSA/RS256 токены подписываются ключом из JWTPrivateKeyFile
+	JWTSecret         string
+	JWTKeyID          string
+	JWTAlgorithm      string
+	JWTPrivateKeyFile string
+	// JWTPreviousSecrets и JWTPublicKeys старые ключи для проверки уже выданных токенов: "kid:secret,..." и "kid:path,..."
+	JWTPreviousSecrets string
+	JWTPublicKeys      string
+
+	// SessionLifetime срок жизни токена пользователя. Токен старше половины срока перевыпускается,
+	// истекший не более SessionGracePeriod назад выдается заново тому же пользователю
+	SessionLifetime    time.Duration
+	SessionGracePeriod time.Duration
+
+	LogLevel string
+
+	// ConfigFile путь к JSON-файлу настроек, PrintConfig выводит итоговые настройки и завершает работу
+	ConfigFile  string
+	PrintConfig bool
+}
+
+// setting связывает флаг с переменной окружения и ключом JSON-файла настроек
+type setting struct {
+	flag   string
+	env    string
+	key    string
+	secret bool
 }
 
-type DataBase struct {
-	Host     string
-	Port     int
-	User     string
-	Password string
-	DBName   string
+// settings все настройки, которые можно задать в файле. Приоритет: файл < окружение < флаги
+var settings = []setting{
+	{flag: "a", env: "SERVER_ADDRESS", key: "server_address"},
+	{flag: "b", env: "BASE_URL", key: "base_url"},
+	{flag: "p", env: "SERVER_PORT", key: "server_port"},
+	{flag: "f", env: "FILE_STORAGE_PATH", key: "file_storage_path"},
+	{flag: "d", env: "DATABASE_DSN", key: "database_dsn", secret: true},
+	{flag: "file-sync", env: "FILE_SYNC_POLICY", key: "file_sync_policy"},
+	{flag: "file-compact-interval", env: "FILE_COMPACT_INTERVAL", key: "file_compact_interval"},
+	{flag: "expired-reap-interval", env: "EXPIRED_REAP_INTERVAL", key: "expired_reap_interval"},
+	{flag: "expired-retention", env: "EXPIRED_RETENTION", key: "expired_retention"},
+	{flag: "max-url-length", env: "MAX_URL_LENGTH", key: "max_url_length"},
+	{flag: "strip-url-fragment", env: "STRIP_URL_FRAGMENT", key: "strip_url_fragment"},
+	{flag: "blocklist-file", env: "BLOCKLIST_FILE", key: "blocklist_file"},
+	{flag: "blocklist-reload-interval", env: "BLOCKLIST_RELOAD_INTERVAL", key: "blocklist_reload_interval"},
+	{flag: "screening-url", env: "SCREENING_URL", key: "screening_url"},
+	{flag: "screening-timeout", env: "SCREENING_TIMEOUT", key: "screening_timeout"},
+	{flag: "dedup-scope", env: "DEDUP_SCOPE", key: "dedup_scope"},
+	{flag: "idempotency-ttl", env: "IDEMPOTENCY_TTL", key: "idempotency_ttl"},
+	{flag: "delete-workers", env: "DELETE_WORKERS", key: "delete_workers"},
+	{flag: "delete-batch-size", env: "DELETE_BATCH_SIZE", key: "delete_batch_size"},
+	{flag: "delete-flush-interval", env: "DELETE_FLUSH_INTERVAL", key: "delete_flush_interval"},
+	{flag: "read-timeout", env: "READ_TIMEOUT", key: "read_timeout"},
+	{flag: "write-timeout", env: "WRITE_TIMEOUT", key: "write_timeout"},
+	{flag: "idle-timeout", env: "IDLE_TIMEOUT", key: "idle_timeout"},
+	{flag: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT", key: "shutdown_timeout"},
+	{flag: "s", env: "ENABLE_HTTPS", key: "enable_https"},
+	{flag: "tls-cert", env: "TLS_CERT_FILE", key: "tls_cert_file"},
+	{flag: "tls-key", env: "TLS_KEY_FILE", key: "tls_key_file"},
+	{flag: "http-redirect", env: "HTTP_REDIRECT_ADDRESS", key: "http_redirect_address"},
+	{flag: "grpc-address", env: "GRPC_ADDRESS", key: "grpc_address"},
+	{flag: "t", env: "TRUSTED_SUBNET", key: "trusted_subnet"},
+	{flag: "metrics-address", env: "METRICS_ADDRESS", key: "metrics_address"},
+	{flag: "tracing-exporter", env: "TRACING_EXPORTER", key: "tracing_exporter"},
+	{flag: "tracing-file", env: "TRACING_FILE", key: "tracing_file"},
+	{flag: "tracing-endpoint", env: "TRACING_ENDPOINT", key: "tracing_endpoint"},
+	{flag: "tracing-insecure", env: "TRACING_INSECURE", key: "tracing_insecure"},
+	{flag: "jwt-secret", env: "JWT_SECRET", key: "jwt_secret", secret: true},
+	{flag: "jwt-key-id", env: "JWT_KEY_ID", key: "jwt_key_id"},
+	{flag: "jwt-alg", env: "JWT_ALGORITHM", key: "jwt_algorithm"},
+	{flag: "jwt-private-key", env: "JWT_PRIVATE_KEY_FILE", key: "jwt_private_key_file"},
+	{flag: "jwt-previous-secrets", env: "JWT_PREVIOUS_SECRETS", key: "jwt_previous_secrets", secret: true},
+	{flag: "jwt-public-keys", env: "JWT_PUBLIC_KEYS", key: "jwt_public_keys"},
+	{flag: "session-lifetime", env: "SESSION_LIFETIME", key: "session_lifetime"},
+	{flag: "session-grace-period", env: "SESSION_GRACE_PERIOD", key: "session_grace_period"},
+	{flag: "log-level", env: "LOG_LEVEL", key: "log_level"},
 }
 
-func NewConfig() *Config {
+const redacted = "*****"
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+// NewConfig собирает настройки из файла, окружения и флагов. Проверка значений — в Validate
+func NewConfig() (*Config, error) {
+	return parseConfig(os.Args[1:])
+}
+
+func parseConfig(args []string) (*Config, error) {
 	config := &Config{}
 
-	flag.StringVar(&config.ServerAddress, "a", "localhost:8080", "HTTP server address")
-	flag.StringVar(&config.BaseURL, "b", "http://localhost:8080", "Base URL for shortened URLs")
-	flag.StringVar(&config.ServerPort, "p", "8080", "HTTP server port")
-	flag.StringVar(&config.FileStoragePath, "f", "/tmp/short-url-db.json", "Path to FILE_STORAGE_PATH")
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	config.registerFlags(fs)
 
-	flag.StringVar(&config.DSN, "d", "", "Database DSN") // Добавляем флаг для строки подключения к БД
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
 
-	flag.Parse()
+	// запоминаем явно заданные флаги, чтобы применить их поверх файла и окружения
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
 
-	config.parseEnv()
+	if envConfig := os.Getenv("CONFIG"); envConfig != "" && explicit["c"] == "" {
+		config.ConfigFile = envConfig
+	}
+	if config.ConfigFile != "" {
+		if err := config.parseFile(fs, config.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
 
-	return config
+	if err := config.parseEnv(fs); err != nil {
+		return nil, err
+	}
+
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	// порт из -p / SERVER_PORT заменяет порт в адресе сервера
+	if config.ServerPort != "" {
+		if host, _, err := net.SplitHostPort(config.ServerAddress); err == nil {
+			config.ServerAddress = net.JoinHostPort(host, config.ServerPort)
+		}
+	}
+	return config, nil
 }
 
-func (c *Config) parseEnv() {
-	if envServerAddress := os.Getenv("SERVER_ADDRESS"); envServerAddress != "" {
-		c.ServerAddress = envServerAddress
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ServerAddress, "a", "localhost:8080", "HTTP server address")
+	fs.StringVar(&c.BaseURL, "b", "http://localhost:8080", "Base URL for shortened URLs")
+	fs.StringVar(&c.ServerPort, "p", "", "HTTP server port, overrides port of server address")
+	fs.StringVar(&c.FileStoragePath, "f", "/tmp/short-url-db.json", "Path to FILE_STORAGE_PATH")
+	fs.StringVar(&c.FileSyncPolicy, "file-sync", "interval", "File storage fsync policy: always, interval or none")
+	fs.DurationVar(&c.FileCompactInterval, "file-compact-interval", 10*time.Minute, "File storage compaction interval, 0 disables compaction")
+
+	fs.DurationVar(&c.ExpiredReapInterval, "expired-reap-interval", time.Hour, "Expired links cleanup interval, 0 disables cleanup")
+	fs.DurationVar(&c.ExpiredRetention, "expired-retention", 7*24*time.Hour, "How long expired links are kept before cleanup")
+
+	fs.IntVar(&c.MaxURLLength, "max-url-length", 2048, "Max length of a shortened URL")
+	fs.BoolVar(&c.StripURLFragment, "strip-url-fragment", false, "Strip #fragment from shortened URLs")
+	fs.StringVar(&c.BlocklistFile, "blocklist-file", "", "Path to destination blocklist, disabled if empty")
+	fs.DurationVar(&c.BlocklistReloadInterval, "blocklist-reload-interval", 30*time.Second, "How often the blocklist file is checked for changes, 0 disables reload")
+	fs.StringVar(&c.ScreeningURL, "screening-url", "", "URL of external screening service, disabled if empty")
+	fs.DurationVar(&c.ScreeningTimeout, "screening-timeout", 2*time.Second, "Timeout of external screening service requests")
+	fs.StringVar(&c.DedupScope, "dedup-scope", "global", "Deduplication of original URLs: global, user or none")
+	fs.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", 24*time.Hour, "How long responses to requests with Idempotency-Key are replayed, 0 disables")
+
+	fs.IntVar(&c.DeleteWorkers, "delete-workers", 2, "Number of URL deletion workers")
+	fs.IntVar(&c.DeleteBatchSize, "delete-batch-size", 100, "Max URLs in one deletion batch")
+	fs.DurationVar(&c.DeleteFlushInterval, "delete-flush-interval", time.Second, "Max delay before a deletion batch is flushed")
+
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 10*time.Second, "HTTP server read timeout")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 10*time.Second, "HTTP server write timeout")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", time.Minute, "HTTP server keep-alive idle timeout")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "Grace period for in-flight requests on shutdown")
+
+	fs.BoolVar(&c.EnableHTTPS, "s", false, "Enable HTTPS")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", "", "Path to TLS certificate, self-signed is generated if empty")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", "", "Path to TLS private key")
+	fs.StringVar(&c.HTTPRedirectAddress, "http-redirect", "", "Address of HTTP listener redirecting to HTTPS")
+	fs.StringVar(&c.GRPCAddress, "grpc-address", "", "Address of gRPC server, disabled if empty")
+	fs.StringVar(&c.TrustedSubnet, "t", "", "CIDR allowed to read internal stats, disabled if empty")
+	fs.StringVar(&c.MetricsAddress, "metrics-address", "", "Address of admin listener for /metrics, main server if empty")
+	fs.StringVar(&c.TracingExporter, "tracing-exporter", "none", "Trace exporter: none, stdout, file or otlp")
+	fs.StringVar(&c.TracingFile, "tracing-file", "traces.json", "File for the file trace exporter")
+	fs.StringVar(&c.TracingEndpoint, "tracing-endpoint", "localhost:4317", "OTLP/gRPC collector address")
+	fs.BoolVar(&c.TracingInsecure, "tracing-insecure", false, "Connect to OTLP collector without TLS")
+
+	fs.StringVar(&c.JWTSecret, "jwt-secret", "", "Secret for signing user tokens with HS256, random if empty")
+	fs.StringVar(&c.JWTKeyID, "jwt-key-id", "1", "Key id (kid) of the active signing key")
+	fs.StringVar(&c.JWTAlgorithm, "jwt-alg", "HS256", "Token signing algorithm: HS256, EdDSA or RS256")
+	fs.StringVar(&c.JWTPrivateKeyFile, "jwt-private-key", "", "Path to PEM private key for EdDSA/RS256")
+	fs.StringVar(&c.JWTPreviousSecrets, "jwt-previous-secrets", "", "Previous HS256 secrets still accepted: kid:secret,...")
+	fs.StringVar(&c.JWTPublicKeys, "jwt-public-keys", "", "Previous public keys still accepted: kid:path,...")
+	fs.DurationVar(&c.SessionLifetime, "session-lifetime", 3*time.Hour, "User token lifetime")
+	fs.DurationVar(&c.SessionGracePeriod, "session-grace-period", 24*time.Hour, "How long after expiry a token can still be renewed")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "Log level")
+
+	fs.StringVar(&c.DSN, "d", "", "Database DSN") // Добавляем флаг для строки подключения к БД
+
+	fs.StringVar(&c.ConfigFile, "c", "", "Path to JSON config file")
+	fs.BoolVar(&c.PrintConfig, "print-config", false, "Print effective config with secrets redacted and exit")
+}
+
+// parseFile применяет настройки из JSON-файла. Неизвестные ключи считаются ошибкой
+func (c *Config) parseFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
 	}
 
-	if envBaseURL := os.Getenv("BASE_URL"); envBaseURL != "" {
-		c.BaseURL = envBaseURL
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%w: parse %s: %s", ErrInvalidConfig, path, err)
 	}
 
-	if serverPort := os.Getenv("SERVER_PORT"); serverPort != "" {
-		c.ServerPort = serverPort
+	byKey := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
 
+	for key, raw := range values {
+		s, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("%w: unknown setting %q in %s", ErrInvalidConfig, key, path)
+		}
+		// строки передаются флагу без кавычек, числа и булевы значения как есть
+		value := string(raw)
+		var str string
+		if err := json.Unmarshal(raw, &str); err == nil {
+			value = str
+		}
+		if err := fs.Set(s.flag, value); err != nil {
+			return fmt.Errorf("%w: %s: %s", ErrInvalidConfig, key, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) parseEnv(fs *flag.FlagSet) error {
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			if err := fs.Set(s.flag, value); err != nil {
+				return fmt.Errorf("%w: %s: %s", ErrInvalidConfig, s.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate проверяет итоговые настройки и возвращает все найденные ошибки сразу
+func (c *Config) Validate() error {
+	var problems []string
+
+	if _, _, err := net.SplitHostPort(c.ServerAddress); err != nil {
+		problems = append(problems, fmt.Sprintf("server_address: %s", err))
+	}
+	if c.GRPCAddress != "" {
+		if _, _, err := net.SplitHostPort(c.GRPCAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("grpc_address: %s", err))
+		} else if c.GRPCAddress == c.ServerAddress {
+			problems = append(problems, "grpc_address: must differ from server_address")
+		}
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("metrics_address: %s", err))
+		} else if c.MetricsAddress == c.ServerAddress || c.MetricsAddress == c.GRPCAddress {
+			problems = append(problems, "metrics_address: must differ from server_address and grpc_address")
+		}
+	}
+	switch c.TracingExporter {
+	case "none", "stdout", "otlp":
+	case "file":
+		if c.TracingFile == "" {
+			problems = append(problems, "tracing_file: required for file exporter")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("tracing_exporter: unknown exporter %q", c.TracingExporter))
+	}
+	if c.TrustedSubnet != "" {
+		if _, _, err := net.ParseCIDR(c.TrustedSubnet); err != nil {
+			problems = append(problems, fmt.Sprintf("trusted_subnet: %s", err))
+		}
+	}
+	if c.ServerPort != "" {
+		if port, err := strconv.Atoi(c.ServerPort); err != nil || port <= 0 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("server_port: invalid port %q", c.ServerPort))
+		}
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("base_url: must be absolute http(s) URL, got %q", c.BaseURL))
+	}
+	if c.ScreeningURL != "" {
+		if u, err := url.Parse(c.ScreeningURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("screening_url: must be absolute http(s) URL, got %q", c.ScreeningURL))
+		}
+	}
+	switch c.DedupScope {
+	case "global", "user", "none":
+	default:
+		problems = append(problems, fmt.Sprintf("dedup_scope: unknown scope %q", c.DedupScope))
+	}
+	switch c.FileSyncPolicy {
+	case "always", "interval", "none":
+	default:
+		problems = append(problems, fmt.Sprintf("file_sync_policy: unknown policy %q", c.FileSyncPolicy))
+	}
+
+	durations := map[string]time.Duration{
+		"file_compact_interval":     c.FileCompactInterval,
+		"expired_reap_interval":     c.ExpiredReapInterval,
+		"expired_retention":         c.ExpiredRetention,
+		"idempotency_ttl":           c.IdempotencyTTL,
+		"blocklist_reload_interval": c.BlocklistReloadInterval,
+		"read_timeout":              c.ReadTimeout,
+		"write_timeout":             c.WriteTimeout,
+		"idle_timeout":              c.IdleTimeout,
+		"session_grace_period":      c.SessionGracePeriod,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			problems = append(problems, fmt.Sprintf("%s: must not be negative", name))
+		}
+	}
+	if c.DeleteFlushInterval <= 0 {
+		problems = append(problems, "delete_flush_interval: must be positive")
+	}
+	if c.SessionLifetime <= 0 {
+		problems = append(problems, "session_lifetime: must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout: must be positive")
+	}
+	if c.DeleteWorkers <= 0 {
+		problems = append(problems, "delete_workers: must be positive")
+	}
+	if c.ScreeningTimeout <= 0 {
+		problems = append(problems, "screening_timeout: must be positive")
+	}
+	if c.MaxURLLength <= 0 {
+		problems = append(problems, "max_url_length: must be positive")
+	}
+	if c.DeleteBatchSize <= 0 {
+		problems = append(problems, "delete_batch_size: must be positive")
 	}
 
-	if envFilePath := os.Getenv("FILE_STORAGE_PATH"); envFilePath != "" {
-		c.FileStoragePath = envFilePath
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, "tls_cert_file and tls_key_file must be set together")
+	}
+	switch c.JWTAlgorithm {
+	case "HS256":
+	case "EdDSA", "RS256":
+		if c.JWTPrivateKeyFile == "" {
+			problems = append(problems, fmt.Sprintf("jwt_private_key_file: required for %s", c.JWTAlgorithm))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("jwt_algorithm: unknown algorithm %q", c.JWTAlgorithm))
 	}
+	if c.JWTKeyID == "" {
+		problems = append(problems, "jwt_key_id: must not be empty")
+	}
+	if _, err := zap.ParseAtomicLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("log_level: %s", err))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(problems, "; "))
+}
 
-	if envDBDSN := os.Getenv("DATABASE_DSN"); envDBDSN != "" {
-		c.DSN = envDBDSN
+// Print выводит итоговые настройки в формате файла настроек, скрывая секреты
+func (c *Config) Print(w io.Writer) error {
+	fs := flag.NewFlagSet("print", flag.ContinueOnError)
+	c.registerFlagsNoDefaults(fs)
+
+	out := make(map[string]any, len(settings))
+	for _, s := range settings {
+		f := fs.Lookup(s.flag)
+		value := f.Value.(flag.Getter).Get()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if s.secret {
+			value = redact(s.key, f.Value.String())
+		}
+		out[s.key] = value
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
+
+// registerFlagsNoDefaults привязывает флаги к полям, не затирая текущие значения
+func (c *Config) registerFlagsNoDefaults(fs *flag.FlagSet) {
+	saved := *c
+	c.registerFlags(fs)
+	*c = saved
+}
+
+var dsnPasswordPattern = regexp.MustCompile(`(password=)\S+`)
+
+func redact(key, value string) string {
+	if value == "" {
+		return ""
+	}
+	if key != "database_dsn" {
+		return redacted
+	}
+	// в DSN скрываем только пароль, остальное полезно для диагностики
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		return u.String()
 	}
+	return dsnPasswordPattern.ReplaceAllString(value, "${1}"+redacted)
 }
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- В short_url храним только идентификатор, BaseURL добавляется при выдаче ответа
+UPDATE shorten_urls
+SET short_url = regexp_replace(short_url, '^.*/', '')
+WHERE short_url LIKE '%/%';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- BaseURL в БД не хранится, восстановить полные ссылки невозможно
+SELECT 1;
+-- +goose StatementEnd
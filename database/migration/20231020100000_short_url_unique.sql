@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Идентификаторы коротких ссылок могут задаваться пользователем, поэтому должны быть уникальными
+CREATE UNIQUE INDEX IF NOT EXISTS short_url_index ON shorten_urls (short_url);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS short_url_index;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE shorten_urls ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+
+CREATE INDEX IF NOT EXISTS expires_at_index ON shorten_urls (expires_at) WHERE expires_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS expires_at_index;
+
+ALTER TABLE shorten_urls DROP COLUMN IF EXISTS expires_at;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Без внешнего ключа: статистика переживает удаление истекших ссылок
+CREATE TABLE IF NOT EXISTS clicks
+(
+    id bigserial PRIMARY KEY,
+    short_url text NOT NULL,
+    clicked_at timestamptz NOT NULL,
+    referrer text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    ip text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS clicks_short_url_index ON clicks (short_url, clicked_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS clicks_short_url_index;
+
+DROP TABLE IF EXISTS clicks;
+-- +goose StatementEnd
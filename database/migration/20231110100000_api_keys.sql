@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id text PRIMARY KEY,
+    user_id int NOT NULL,
+    name text NOT NULL DEFAULT '',
+    key_hash text NOT NULL,
+    scopes text[] NOT NULL DEFAULT '{}',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    revoked_at timestamptz
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS api_keys_key_hash_index ON api_keys (key_hash);
+CREATE INDEX IF NOT EXISTS api_keys_user_id_index ON api_keys (user_id) WHERE revoked_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS api_keys_user_id_index;
+
+DROP INDEX IF EXISTS api_keys_key_hash_index;
+
+DROP TABLE IF EXISTS api_keys;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users_links ADD COLUMN IF NOT EXISTS email text;
+ALTER TABLE users_links ADD COLUMN IF NOT EXISTS password_hash text;
+ALTER TABLE users_links ADD COLUMN IF NOT EXISTS registered_at timestamptz;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_links_email_index ON users_links (email) WHERE email IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_links_email_index;
+
+ALTER TABLE users_links DROP COLUMN IF EXISTS registered_at;
+ALTER TABLE users_links DROP COLUMN IF EXISTS password_hash;
+ALTER TABLE users_links DROP COLUMN IF EXISTS email;
+-- +goose StatementEnd
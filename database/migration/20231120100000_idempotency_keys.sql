@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    user_id int NOT NULL,
+    key text NOT NULL,
+    request_hash text NOT NULL,
+    status_code int NOT NULL DEFAULT 0,
+    content_type text NOT NULL DEFAULT '',
+    body bytea,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    expires_at timestamptz NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_index ON idempotency_keys (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idempotency_keys_expires_at_index;
+
+DROP TABLE IF EXISTS idempotency_keys;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- dedup_owner — в пределах кого original_url уникален: 0 — все пользователи, id пользователя — только его ссылки,
+-- NULL — ссылка не участвует в дедупликации
+ALTER TABLE shorten_urls ADD COLUMN IF NOT EXISTS dedup_owner int;
+
+-- до миграции original_url был уникален для всех пользователей
+UPDATE shorten_urls SET dedup_owner = 0;
+
+DROP INDEX IF EXISTS original_url_index;
+
+CREATE UNIQUE INDEX IF NOT EXISTS dedup_original_url_index ON shorten_urls (dedup_owner, original_url);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- откат возможен, только если original_url не повторяются
+DROP INDEX IF EXISTS dedup_original_url_index;
+
+CREATE UNIQUE INDEX IF NOT EXISTS original_url_index ON shorten_urls (original_url);
+
+ALTER TABLE shorten_urls DROP COLUMN IF EXISTS dedup_owner;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+-- переходы удаляются вместе с истекшими ссылками; оставшиеся от ранее удаленных ссылок
+-- достались бы следующему владельцу short_url
+DELETE FROM clicks WHERE NOT EXISTS (SELECT 1 FROM shorten_urls WHERE shorten_urls.short_url = clicks.short_url);
+-- +goose StatementEnd
+
+-- +goose Down
+-- удаленные переходы не восстанавливаются
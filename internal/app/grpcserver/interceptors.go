@@ -0,0 +1,188 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/Tokebay/yandex/internal/app/handlers"
+	"github.com/Tokebay/yandex/internal/logger"
+	pb "github.com/Tokebay/yandex/internal/proto"
+	"github.com/Tokebay/yandex/internal/tracing"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AuthorizationMetadata ключ metadata с учетными данными: "Bearer <JWT или ключ доступа>".
+// Новому пользователю токен возвращается в заголовке ответа с тем же ключом
+const AuthorizationMetadata = "authorization"
+
+const bearerPrefix = "Bearer "
+
+// requestIDMetadata ключ metadata с id запроса, в gRPC ключи в нижнем регистре
+var requestIDMetadata = strings.ToLower(logger.RequestIDHeader)
+
+// methodAuth режим проверки и область доступа метода, как у соответствующего HTTP-маршрута
+type methodAuth struct {
+	mode  handlers.AuthMode
+	scope string
+}
+
+// методы без записи в таблице доступны без учетных данных
+var methodsAuth = map[string]methodAuth{
+	pb.Shortener_Shorten_FullMethodName:        {mode: handlers.ProvisionUser, scope: handlers.ScopeShorten},
+	pb.Shortener_ShortenBatch_FullMethodName:   {mode: handlers.ProvisionUser, scope: handlers.ScopeShorten},
+	pb.Shortener_ListUserURLs_FullMethodName:   {mode: handlers.RequireUser, scope: handlers.ScopeRead},
+	pb.Shortener_DeleteUserURLs_FullMethodName: {mode: handlers.RequireUser, scope: handlers.ScopeDelete},
+}
+
+// AuthInterceptor определяет пользователя по metadata и кладет его в контекст, как Authenticate для HTTP
+func AuthInterceptor(shortener *handlers.URLShortener) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		auth, ok := methodsAuth[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		identity, err := credentialIdentity(ctx, shortener, auth.scope)
+		if err != nil {
+			logger.FromContext(ctx).Info("Authentication failed", zap.String("method", info.FullMethod), zap.Error(err))
+			return nil, err
+		}
+
+		if identity.UserID == 0 {
+			if auth.mode == handlers.RequireUser {
+				return nil, status.Error(codes.Unauthenticated, "authorization metadata is required")
+			}
+			var token string
+			identity, token, err = shortener.NewAnonymousUser(ctx)
+			if err != nil {
+				return nil, status.Error(codes.Internal, "Internal Server Error")
+			}
+			if err := grpc.SetHeader(ctx, metadata.Pairs(AuthorizationMetadata, bearerPrefix+token)); err != nil {
+				logger.FromContext(ctx).Error("Error sending token header", zap.Error(err))
+			}
+		}
+
+		return handler(handlers.WithIdentity(ctx, identity), req)
+	}
+}
+
+// credentialIdentity проверяет учетные данные из metadata. Без них возвращает пустую Identity
+func credentialIdentity(ctx context.Context, shortener *handlers.URLShortener, scope string) (handlers.Identity, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(AuthorizationMetadata)
+	if len(values) == 0 || values[0] == "" {
+		return handlers.Identity{}, nil
+	}
+
+	authorization := values[0]
+	if len(authorization) < len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return handlers.Identity{}, status.Error(codes.Unauthenticated, "expected Bearer authorization")
+	}
+	credential := strings.TrimSpace(authorization[len(bearerPrefix):])
+
+	identity, err := shortener.CredentialIdentity(ctx, credential, scope)
+	switch {
+	case err == nil:
+		return identity, nil
+	case errors.Is(err, handlers.ErrInsufficientScope):
+		return handlers.Identity{}, status.Errorf(codes.PermissionDenied, "api key has no %q scope", scope)
+	case errors.Is(err, handlers.ErrTokenExpired):
+		return handlers.Identity{}, status.Error(codes.Unauthenticated, "token expired, sign in again")
+	case errors.Is(err, handlers.ErrToken):
+		return handlers.Identity{}, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return handlers.Identity{}, status.Error(codes.Internal, "Internal Server Error")
+}
+
+// identityFromContext достает пользователя, найденного AuthInterceptor
+func identityFromContext(ctx context.Context) (handlers.Identity, error) {
+	identity, ok := handlers.IdentityFromContext(ctx)
+	if !ok || identity.UserID == 0 {
+		return handlers.Identity{}, status.Error(codes.Unauthenticated, "authorization metadata is required")
+	}
+	return identity, nil
+}
+
+// requestIDInterceptor принимает или выдает x-request-id, как logger.RequestIDMiddleware для HTTP
+func requestIDInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var clientID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIDMetadata); len(values) > 0 {
+			clientID = values[0]
+		}
+	}
+	requestID := logger.NewRequestID(clientID)
+	ctx = logger.WithRequestID(ctx, requestID)
+	if err := grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, requestID)); err != nil {
+		logger.FromContext(ctx).Error("Error sending request id header", zap.Error(err))
+	}
+
+	resp, err := handler(ctx, req)
+	logger.FromContext(ctx).Info("Request handled", zap.String("method", info.FullMethod), zap.String("code", status.Code(err).String()))
+	return resp, err
+}
+
+// tracingInterceptor открывает спан вызова, продолжая трассу из traceparent в metadata
+func tracingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	ctx, span := tracing.Start(ctx, info.FullMethod,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCMethod(info.FullMethod)),
+	)
+	defer span.End()
+	if spanContext := span.SpanContext(); spanContext.IsValid() {
+		ctx = logger.WithLogger(ctx, logger.FromContext(ctx).With(zap.String("trace_id", spanContext.TraceID().String())))
+	}
+
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if code == codes.Internal || code == codes.Unavailable || code == codes.Unknown {
+		span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+	}
+	return resp, err
+}
+
+// metadataCarrier позволяет распространителю OpenTelemetry читать metadata gRPC
+type metadataCarrier metadata.MD
+
+func (mc metadataCarrier) Get(key string) string {
+	values := metadata.MD(mc).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (mc metadataCarrier) Set(key, value string) {
+	metadata.MD(mc).Set(key, value)
+}
+
+func (mc metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(mc))
+	for key := range mc {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// recoveryInterceptor отвечает Internal вместо падения сервера при панике в обработчике
+func recoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.FromContext(ctx).Error("Panic in gRPC handler", zap.String("method", info.FullMethod), zap.Any("panic", r))
+			err = status.Error(codes.Internal, "Internal Server Error")
+		}
+	}()
+	return handler(ctx, req)
+}
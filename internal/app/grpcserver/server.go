@@ -0,0 +1,178 @@
+// Package grpcserver отдает API сокращателя по gRPC поверх той же логики URLShortener, что и HTTP-маршруты
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/app/handlers"
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	pb "github.com/Tokebay/yandex/internal/proto"
+	"github.com/Tokebay/yandex/internal/screening"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type Server struct {
+	pb.UnimplementedShortenerServer
+
+	shortener *handlers.URLShortener
+}
+
+// NewServer создает gRPC-сервер с проверкой пользователя и регистрирует на нем сервис
+func NewServer(shortener *handlers.URLShortener, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(
+		requestIDInterceptor,
+		tracingInterceptor,
+		recoveryInterceptor,
+		AuthInterceptor(shortener),
+	))
+	s := grpc.NewServer(opts...)
+	pb.RegisterShortenerServer(s, &Server{shortener: shortener})
+	return s
+}
+
+func (s *Server) Shorten(ctx context.Context, req *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	identity, err := identityFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	shortURL, created, err := s.shortener.ShortenURL(ctx, identity.UserID, models.Request{
+		URL:         req.GetUrl(),
+		CustomAlias: req.GetCustomAlias(),
+		ExpiresAt:   timeFromProto(req.GetExpiresAt()),
+		TTLSeconds:  req.GetTtlSeconds(),
+	})
+	if err != nil {
+		return nil, statusFromError(ctx, err, "Error saving URL")
+	}
+	return &pb.ShortenResponse{ShortUrl: shortURL, AlreadyExists: !created}, nil
+}
+
+func (s *Server) ShortenBatch(ctx context.Context, req *pb.ShortenBatchRequest) (*pb.ShortenBatchResponse, error) {
+	identity, err := identityFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make(models.BatchShortenRequest, 0, len(req.GetUrls()))
+	for _, url := range req.GetUrls() {
+		batch = append(batch, models.BatchShortenRequestItem{
+			CorrelationID: url.GetCorrelationId(),
+			OriginalURL:   url.GetOriginalUrl(),
+			CustomAlias:   url.GetCustomAlias(),
+			ExpiresAt:     timeFromProto(url.GetExpiresAt()),
+			TTLSeconds:    url.GetTtlSeconds(),
+		})
+	}
+
+	shortURLs, created, err := s.shortener.ShortenBatch(ctx, identity.UserID, batch)
+	if err != nil {
+		return nil, statusFromError(ctx, err, "Error saving batch URLs")
+	}
+
+	resp := &pb.ShortenBatchResponse{
+		Urls:          make([]*pb.ShortenBatchResponse_Item, 0, len(shortURLs)),
+		AlreadyExists: !created,
+	}
+	for _, url := range shortURLs {
+		resp.Urls = append(resp.Urls, &pb.ShortenBatchResponse_Item{
+			CorrelationId: url.CorrelationID,
+			ShortUrl:      url.ShortURL,
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) Resolve(ctx context.Context, req *pb.ResolveRequest) (*pb.ResolveResponse, error) {
+	url, err := s.shortener.ResolveURL(ctx, req.GetId())
+	if err != nil {
+		return nil, statusFromError(ctx, err, "Error get URL from storage")
+	}
+	return &pb.ResolveResponse{OriginalUrl: url.OriginalURL}, nil
+}
+
+func (s *Server) ListUserURLs(ctx context.Context, _ *pb.ListUserURLsRequest) (*pb.ListUserURLsResponse, error) {
+	identity, err := identityFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := s.shortener.UserURLs(ctx, identity.UserID)
+	if err != nil {
+		return nil, statusFromError(ctx, err, "Error getting user URLs from storage")
+	}
+
+	resp := &pb.ListUserURLsResponse{Urls: make([]*pb.ListUserURLsResponse_Item, 0, len(urls))}
+	for _, url := range urls {
+		item := &pb.ListUserURLsResponse_Item{
+			ShortUrl:    url.ShortURL,
+			OriginalUrl: url.OriginalURL,
+		}
+		if url.ExpiresAt != nil {
+			item.ExpiresAt = timestamppb.New(*url.ExpiresAt)
+		}
+		resp.Urls = append(resp.Urls, item)
+	}
+	return resp, nil
+}
+
+func (s *Server) DeleteUserURLs(ctx context.Context, req *pb.DeleteUserURLsRequest) (*pb.DeleteUserURLsResponse, error) {
+	identity, err := identityFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.shortener.DeleteUserURLs(ctx, identity.UserID, req.GetIds()); err != nil {
+		return nil, statusFromError(ctx, err, "Error enqueue URLs deletion")
+	}
+	return &pb.DeleteUserURLsResponse{}, nil
+}
+
+func (s *Server) Ping(ctx context.Context, _ *pb.PingRequest) (*pb.PingResponse, error) {
+	if err := s.shortener.Ping(ctx); err != nil {
+		logger.FromContext(ctx).Error("Error connect to DB", zap.Error(err))
+		return nil, status.Error(codes.Unavailable, "Error connect to DB")
+	}
+	return &pb.PingResponse{}, nil
+}
+
+// statusFromError переводит ошибки сервиса в коды gRPC так же, как HTTP-обработчики переводят их в статусы
+func statusFromError(ctx context.Context, err error, logMessage string) error {
+	switch {
+	case handlers.IsValidationError(err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, storage.ErrShortURLExists):
+		return status.Error(codes.AlreadyExists, "custom alias is already taken")
+	case errors.Is(err, storage.ErrURLNotFound):
+		return status.Error(codes.NotFound, "URL not found")
+	case errors.Is(err, handlers.ErrURLGone):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, screening.ErrBlocked):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, screening.ErrLookupUnavailable):
+		logger.FromContext(ctx).Error(logMessage, zap.Error(err))
+		return status.Error(codes.Unavailable, "Service Unavailable")
+	case errors.Is(err, handlers.ErrDeleteQueueClosed):
+		return status.Error(codes.Unavailable, "Service Unavailable")
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	logger.FromContext(ctx).Error(logMessage, zap.Error(err))
+	return status.Error(codes.Internal, "Internal Server Error")
+}
+
+func timeFromProto(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
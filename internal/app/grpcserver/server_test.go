@@ -0,0 +1,156 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Tokebay/yandex/config"
+	"github.com/Tokebay/yandex/internal/app/handlers"
+	"github.com/Tokebay/yandex/internal/app/storage"
+	pb "github.com/Tokebay/yandex/internal/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestClient(t *testing.T) pb.ShortenerClient {
+	cfg := &config.Config{
+		BaseURL:             "http://localhost:8080",
+		SessionLifetime:     time.Hour,
+		DeleteFlushInterval: 10 * time.Millisecond,
+	}
+	us := handlers.NewURLShortener(cfg, storage.NewMapStorage(), nil)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewServer(us)
+	go server.Serve(listener)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+		us.StopDeleteWorkers()
+		us.StopClickRecorder()
+	})
+	return pb.NewShortenerClient(conn)
+}
+
+func TestServer(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	// без токена пользователь создается, токен приходит в заголовке ответа
+	var header metadata.MD
+	resp, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://practicum.yandex.ru", CustomAlias: "yandex"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/yandex", resp.GetShortUrl())
+	assert.False(t, resp.GetAlreadyExists())
+	tokens := header.Get(AuthorizationMetadata)
+	require.Len(t, tokens, 1)
+	userCtx := metadata.AppendToOutgoingContext(ctx, AuthorizationMetadata, tokens[0])
+
+	resp, err = client.Shorten(userCtx, &pb.ShortenRequest{Url: "https://practicum.yandex.ru"})
+	require.NoError(t, err)
+	assert.True(t, resp.GetAlreadyExists())
+	assert.Equal(t, "http://localhost:8080/yandex", resp.GetShortUrl())
+
+	batch, err := client.ShortenBatch(userCtx, &pb.ShortenBatchRequest{Urls: []*pb.ShortenBatchRequest_Item{
+		{CorrelationId: "1", OriginalUrl: "https://go.dev", CustomAlias: "golang"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, batch.GetUrls(), 1)
+	assert.Equal(t, "1", batch.GetUrls()[0].GetCorrelationId())
+	assert.Equal(t, "http://localhost:8080/golang", batch.GetUrls()[0].GetShortUrl())
+
+	list, err := client.ListUserURLs(userCtx, &pb.ListUserURLsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, list.GetUrls(), 2)
+
+	resolved, err := client.Resolve(ctx, &pb.ResolveRequest{Id: "golang"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://go.dev", resolved.GetOriginalUrl())
+
+	_, err = client.DeleteUserURLs(userCtx, &pb.DeleteUserURLsRequest{Ids: []string{"golang"}})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := client.Resolve(ctx, &pb.ResolveRequest{Id: "golang"})
+		return status.Code(err) == codes.FailedPrecondition
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = client.Ping(ctx, &pb.PingRequest{})
+	assert.NoError(t, err)
+}
+
+func TestServerErrors(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{
+			name: "list without token",
+			call: func() error {
+				_, err := client.ListUserURLs(ctx, &pb.ListUserURLsRequest{})
+				return err
+			},
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "invalid token",
+			call: func() error {
+				md := metadata.AppendToOutgoingContext(ctx, AuthorizationMetadata, "Bearer garbage")
+				_, err := client.DeleteUserURLs(md, &pb.DeleteUserURLsRequest{Ids: []string{"abc"}})
+				return err
+			},
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "invalid alias",
+			call: func() error {
+				_, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://go.dev", CustomAlias: "a"})
+				return err
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "conflicting expiration",
+			call: func() error {
+				_, err := client.ShortenBatch(ctx, &pb.ShortenBatchRequest{Urls: []*pb.ShortenBatchRequest_Item{
+					{CorrelationId: "1", OriginalUrl: "https://go.dev", TtlSeconds: -1},
+				}})
+				return err
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "unknown url",
+			call: func() error {
+				_, err := client.Resolve(ctx, &pb.ResolveRequest{Id: "missing"})
+				return err
+			},
+			code: codes.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, status.Code(tt.call()))
+		})
+	}
+}
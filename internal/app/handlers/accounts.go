@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt учитывает только первые 72 байта пароля
+	maxPasswordLength = 72
+	maxEmailLength    = 254
+
+	AuthErrorCredentials = "invalid_credentials"
+)
+
+var ErrInvalidEmail = errors.New("invalid email")
+var ErrInvalidPassword = errors.New("password must be 8 to 72 bytes long")
+
+// dummyPasswordHash сравнивается при входе с неизвестным email, чтобы время ответа не выдавало,
+// зарегистрирован ли адрес
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if len(email) > maxEmailLength {
+		return "", ErrInvalidEmail
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// anonymousUserID возвращает пользователя из cookie, не отвечая ошибкой: при входе
+// неверный токен или истекший дольше SessionGracePeriod назад просто игнорируется
+func (us *URLShortener) anonymousUserID(r *http.Request) int {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return 0
+	}
+	claims, err := ParseToken(cookie.Value)
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		if !us.withinGracePeriod(claims, time.Now()) {
+			return 0
+		}
+	case err != nil:
+		return 0
+	}
+	return claims.UserID
+}
+
+// RegisterHandler регистрирует пользователя по email и паролю. Анонимный пользователь из cookie
+// становится учетной записью вместе со всеми своими ссылками
+func (us *URLShortener) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.Credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode request", http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error hashing password", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	registeredAt := time.Now().UTC()
+	user := models.User{
+		ID:           userID,
+		Email:        email,
+		PasswordHash: string(passwordHash),
+		RegisteredAt: &registeredAt,
+	}
+	err = us.Storage.RegisterUser(r.Context(), user)
+	switch {
+	case errors.Is(err, storage.ErrEmailTaken):
+		http.Error(w, "email already registered", http.StatusConflict)
+		return
+	case errors.Is(err, storage.ErrAlreadyRegistered):
+		http.Error(w, "user already registered, log out first", http.StatusConflict)
+		return
+	case err != nil:
+		logger.FromContext(r.Context()).Error("Error registering user", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if us.fileStorage != nil {
+		err := us.fileOp(r.Context(), "save_user", func() error { return us.fileStorage.SaveUser(user) })
+		if err != nil {
+			logger.FromContext(r.Context()).Error("Error saving user to file", zap.Error(err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := us.setSessionCookie(w, r, userID); err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.UserResponse{UserID: userID, Email: email})
+}
+
+// LoginHandler выдает сессию учетной записи. Ссылки анонимного пользователя из cookie переходят к ней
+func (us *URLShortener) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.Credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode request", http.StatusBadRequest)
+		return
+	}
+
+	user, err := us.Storage.GetUserByEmail(r.Context(), strings.ToLower(strings.TrimSpace(req.Email)))
+	if err != nil && !errors.Is(err, storage.ErrUserNotFound) {
+		logger.FromContext(r.Context()).Error("Error getting user by email", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	passwordHash := dummyPasswordHash
+	if err == nil {
+		passwordHash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(req.Password)) != nil || err != nil {
+		writeAuthError(w, AuthErrorCredentials, "invalid email or password")
+		return
+	}
+
+	if err := us.adoptAnonymousUser(r, user.ID); err != nil {
+		logger.FromContext(r.Context()).Error("Error merging anonymous user", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := us.setSessionCookie(w, r, user.ID); err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.UserResponse{UserID: user.ID, Email: user.Email})
+}
+
+// adoptAnonymousUser передает учетной записи ссылки анонимного пользователя из cookie.
+// Сессия другой учетной записи не трогается
+func (us *URLShortener) adoptAnonymousUser(r *http.Request, userID int) error {
+	anonymousID := us.anonymousUserID(r)
+	if anonymousID == 0 || anonymousID == userID {
+		return nil
+	}
+	anonymous, err := us.Storage.GetUser(r.Context(), anonymousID)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if anonymous.IsRegistered() {
+		return nil
+	}
+
+	if err := us.Storage.MergeUsers(r.Context(), anonymousID, userID); err != nil {
+		return err
+	}
+	if us.fileStorage != nil {
+		return us.fileOp(r.Context(), "merge_users", func() error { return us.fileStorage.MergeUsers(anonymousID, userID) })
+	}
+	return nil
+}
+
+// LogoutHandler удаляет cookie сессии
+func (us *URLShortener) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	if us.config.EnableHTTPS {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, cookie)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePasswordHandler меняет пароль учетной записи после проверки текущего
+func (us *URLShortener) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode request", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := us.Storage.GetUser(r.Context(), userID)
+	if err != nil && !errors.Is(err, storage.ErrUserNotFound) {
+		logger.FromContext(r.Context()).Error("Error getting user", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !user.IsRegistered() {
+		http.Error(w, "user is not registered", http.StatusForbidden)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.OldPassword)) != nil {
+		writeAuthError(w, AuthErrorCredentials, "invalid password")
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error hashing password", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := us.Storage.UpdatePassword(r.Context(), userID, string(passwordHash)); err != nil {
+		logger.FromContext(r.Context()).Error("Error updating password", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if us.fileStorage != nil {
+		user.PasswordHash = string(passwordHash)
+		err := us.fileOp(r.Context(), "save_user", func() error { return us.fileStorage.SaveUser(user) })
+		if err != nil {
+			logger.FromContext(r.Context()).Error("Error saving user to file", zap.Error(err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	aliasMinLen = 3
+	aliasMaxLen = 64
+	// aliasParam параметр запроса POST / с пользовательским идентификатором
+	aliasParam = "custom_alias"
+)
+
+var ErrAliasInvalid = errors.New("invalid custom alias")
+var ErrAliasReserved = errors.New("custom alias is reserved")
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedAliases совпадают с первым сегментом путей роутера и не могут быть идентификаторами
+var reservedAliases = map[string]struct{}{
+	"ping":    {},
+	"api":     {},
+	"metrics": {},
+	"healthz": {},
+	"readyz":  {},
+}
+
+// ValidateAlias проверяет пользовательский идентификатор короткой ссылки
+func ValidateAlias(alias string) error {
+	if len(alias) < aliasMinLen || len(alias) > aliasMaxLen {
+		return fmt.Errorf("%w: length must be from %d to %d", ErrAliasInvalid, aliasMinLen, aliasMaxLen)
+	}
+	if !aliasPattern.MatchString(alias) {
+		return fmt.Errorf("%w: only latin letters, digits, '_' and '-' are allowed", ErrAliasInvalid)
+	}
+	if _, ok := reservedAliases[strings.ToLower(alias)]; ok {
+		return fmt.Errorf("%w: %s", ErrAliasReserved, alias)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+// области доступа ключей
+const (
+	ScopeShorten = "shorten"
+	ScopeRead    = "read"
+	ScopeDelete  = "delete"
+	// ScopeManageKeys и ScopeAccount доступны только по токену сессии, ключам их выдать нельзя
+	ScopeManageKeys = "keys"
+	ScopeAccount    = "account"
+)
+
+const (
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+	// APIKeyPrefix отличает ключи доступа от JWT в заголовке Authorization
+	APIKeyPrefix   = "sk_"
+	apiKeyIDBytes  = 8
+	apiKeyBytes    = 32
+	maxAPIKeyName  = 100
+	apiKeyIDParam  = "id"
+	maxUserAPIKeys = 50
+)
+
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+var grantableScopes = map[string]bool{
+	ScopeShorten: true,
+	ScopeRead:    true,
+	ScopeDelete:  true,
+}
+
+// bearerIdentity проверяет заголовок Authorization: Bearer с JWT или ключом доступа.
+// В отличие от cookie, токен из заголовка не продлевается
+func (us *URLShortener) bearerIdentity(w http.ResponseWriter, r *http.Request, authorization, scope string) (Identity, error) {
+	if len(authorization) < len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		writeAuthError(w, AuthErrorInvalid, "expected Bearer authorization")
+		return Identity{}, ErrToken
+	}
+	credential := strings.TrimSpace(authorization[len(bearerPrefix):])
+
+	identity, err := us.CredentialIdentity(r.Context(), credential, scope)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrInsufficientScope):
+		writeJSONError(w, http.StatusForbidden, AuthErrorScope, fmt.Sprintf("api key has no %q scope", scope))
+	case errors.Is(err, ErrTokenExpired):
+		writeAuthError(w, AuthErrorExpired, "token expired, sign in again")
+	case errors.Is(err, ErrToken):
+		writeAuthError(w, AuthErrorInvalid, "invalid token")
+	default:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+	return identity, err
+}
+
+// CredentialIdentity проверяет JWT или ключ доступа без привязки к транспорту.
+// Ошибки: ErrToken для неверных учетных данных, ErrTokenExpired, ErrInsufficientScope
+func (us *URLShortener) CredentialIdentity(ctx context.Context, credential, scope string) (Identity, error) {
+	if strings.HasPrefix(credential, APIKeyPrefix) {
+		key, err := us.Storage.GetAPIKeyByHash(ctx, hashAPIKey(credential))
+		if errors.Is(err, storage.ErrAPIKeyNotFound) || (err == nil && key.IsRevoked()) {
+			return Identity{}, fmt.Errorf("%w: invalid api key", ErrToken)
+		}
+		if err != nil {
+			logger.FromContext(ctx).Error("Error getting api key", zap.Error(err))
+			return Identity{}, err
+		}
+		if !grantableScopes[scope] || !key.HasScope(scope) {
+			return Identity{}, ErrInsufficientScope
+		}
+		return Identity{UserID: key.UserID, APIKeyID: key.ID}, nil
+	}
+
+	claims, err := ParseToken(credential)
+	if errors.Is(err, ErrTokenExpired) {
+		return Identity{}, err
+	}
+	if err != nil {
+		// ParseToken возвращает и ErrParseClaims, снаружи это одна ошибка неверного токена
+		return Identity{}, ErrToken
+	}
+	return Identity{UserID: claims.UserID}, nil
+}
+
+// newAPIKey генерирует ключ вида sk_<id>_<секрет>. Возвращает id и сам ключ
+func newAPIKey() (string, string, error) {
+	idBytes := make([]byte, apiKeyIDBytes)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	secret := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	id := hex.EncodeToString(idBytes)
+	return id, APIKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashAPIKey ключ случайный и длинный, поэтому медленный хеш для него не нужен
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !grantableScopes[scope] {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+func apiKeyResponse(key models.APIKey) models.APIKeyResponse {
+	scopes := key.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{ScopeShorten, ScopeRead, ScopeDelete}
+	}
+	return models.APIKeyResponse{
+		ID:        key.ID,
+		Name:      key.Name,
+		Scopes:    scopes,
+		CreatedAt: key.CreatedAt,
+	}
+}
+
+// CreateAPIKeyHandler создает ключ доступа. Сам ключ возвращается только в этом ответе
+func (us *URLShortener) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
+
+	var req models.CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to decode request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Name) > maxAPIKeyName {
+		http.Error(w, "name is too long", http.StatusBadRequest)
+		return
+	}
+	if err := validateScopes(req.Scopes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := us.Storage.GetUserAPIKeys(r.Context(), userID)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error getting user api keys", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(keys) >= maxUserAPIKeys {
+		http.Error(w, "too many api keys", http.StatusConflict)
+		return
+	}
+
+	id, secret, err := newAPIKey()
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error generating api key", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	key := models.APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      req.Name,
+		KeyHash:   hashAPIKey(secret),
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := us.Storage.SaveAPIKey(r.Context(), key); err != nil {
+		logger.FromContext(r.Context()).Error("Error saving api key", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if us.fileStorage != nil {
+		err := us.fileOp(r.Context(), "save_api_key", func() error { return us.fileStorage.SaveAPIKey(key) })
+		if err != nil {
+			logger.FromContext(r.Context()).Error("Error saving api key to file", zap.Error(err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp := apiKeyResponse(key)
+	resp.Key = secret
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ListAPIKeysHandler возвращает действующие ключи пользователя без самих ключей
+func (us *URLShortener) ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
+
+	keys, err := us.Storage.GetUserAPIKeys(r.Context(), userID)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error getting user api keys", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	resp := make([]models.APIKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, apiKeyResponse(key))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RevokeAPIKeyHandler отзывает ключ пользователя
+func (us *URLShortener) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
+
+	id := chi.URLParam(r, apiKeyIDParam)
+	revokedAt := time.Now().UTC()
+	err := us.Storage.RevokeAPIKey(r.Context(), userID, id, revokedAt)
+	if errors.Is(err, storage.ErrAPIKeyNotFound) {
+		http.Error(w, "api key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error revoking api key", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if us.fileStorage != nil {
+		err := us.fileOp(r.Context(), "revoke_api_key", func() error { return us.fileStorage.RevokeAPIKey(userID, id, revokedAt) })
+		if err != nil {
+			logger.FromContext(r.Context()).Error("Error saving api key revocation to file", zap.Error(err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
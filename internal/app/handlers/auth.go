@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Tokebay/yandex/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Identity пользователь, от имени которого выполняется запрос
+type Identity struct {
+	UserID int
+	// APIKeyID ключ доступа, которым подписан запрос. Пустой для сессии
+	APIKeyID string
+	// IsNew пользователь создан этим запросом
+	IsNew bool
+}
+
+type identityContextKey struct{}
+
+// AuthMode определяет, что делать с запросом без учетных данных
+type AuthMode int
+
+const (
+	// ProvisionUser создает анонимного пользователя и выдает ему cookie
+	ProvisionUser AuthMode = iota
+	// RequireUser отвечает 401
+	RequireUser
+)
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(Identity)
+	return identity, ok
+}
+
+// Authenticate определяет пользователя один раз до обработчика и кладет его в контекст запроса.
+// scope — операция маршрута, которую должен разрешать ключ доступа
+func (us *URLShortener) Authenticate(mode AuthMode, scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := us.resolveIdentity(w, r, scope)
+			if err != nil {
+				logger.FromContext(r.Context()).Info("Authentication failed", zap.String("path", r.URL.Path), zap.Error(err))
+				return
+			}
+
+			if identity.UserID == 0 {
+				if mode == RequireUser {
+					writeAuthError(w, AuthErrorMissing, "token cookie or Authorization header is required")
+					return
+				}
+				identity, err = us.provisionUser(w, r)
+				if err != nil {
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// provisionUser создает анонимного пользователя и выдает ему cookie. При ошибке ответ уже записан
+func (us *URLShortener) provisionUser(w http.ResponseWriter, r *http.Request) (Identity, error) {
+	identity, token, err := us.NewAnonymousUser(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return Identity{}, err
+	}
+	setTokenCookie(w, token, us.config.EnableHTTPS)
+	return identity, nil
+}
+
+// NewAnonymousUser создает анонимного пользователя и выпускает ему токен сессии
+func (us *URLShortener) NewAnonymousUser(ctx context.Context) (Identity, string, error) {
+	userID, err := us.Storage.InsertUser(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("Error Insert Users", zap.Error(err))
+		return Identity{}, "", err
+	}
+	// у анонимного пользователя может не быть ссылок, по которым счетчик восстановится из файла
+	if us.fileStorage != nil {
+		err := us.fileOp(ctx, "reserve_user_id", func() error { return us.fileStorage.ReserveUserID(userID) })
+		if err != nil {
+			logger.FromContext(ctx).Error("Error reserving user id in file", zap.Error(err))
+			return Identity{}, "", err
+		}
+	}
+
+	token, err := BuildSessionToken(userID, us.sessionLifetime())
+	if err != nil {
+		logger.FromContext(ctx).Error("NewAnonymousUser. error BuildSessionToken", zap.Error(err))
+		return Identity{}, "", err
+	}
+	return Identity{UserID: userID, IsNew: true}, token, nil
+}
+
+// requireIdentity достает пользователя, найденного Authenticate. Маршрут без Authenticate получает 401
+func requireIdentity(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	identity, ok := IdentityFromContext(r.Context())
+	if !ok || identity.UserID == 0 {
+		writeAuthError(w, AuthErrorMissing, "token cookie or Authorization header is required")
+		return Identity{}, false
+	}
+	return identity, true
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Tokebay/yandex/config"
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticate(t *testing.T) {
+	us := NewURLShortener(&config.Config{SessionLifetime: time.Hour}, storage.NewMapStorage(), nil)
+	defer us.StopDeleteWorkers()
+
+	token, err := BuildSessionToken(7, time.Hour)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		mode       AuthMode
+		token      string
+		statusCode int
+		identity   Identity
+	}{
+		{name: "ProvisionNew", mode: ProvisionUser, statusCode: http.StatusOK, identity: Identity{UserID: 1, IsNew: true}},
+		{name: "ProvisionExisting", mode: ProvisionUser, token: token, statusCode: http.StatusOK, identity: Identity{UserID: 7}},
+		{name: "RequireExisting", mode: RequireUser, token: token, statusCode: http.StatusOK, identity: Identity{UserID: 7}},
+		{name: "RequireMissing", mode: RequireUser, statusCode: http.StatusUnauthorized},
+		{name: "RequireInvalid", mode: RequireUser, token: "garbage", statusCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Identity
+			handler := us.Authenticate(tt.mode, ScopeRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity, ok := requireIdentity(w, r)
+				if ok {
+					got = identity
+				}
+			}))
+
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				request.AddCookie(&http.Cookie{Name: CookieName, Value: tt.token})
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, tt.identity, got)
+		})
+	}
+}
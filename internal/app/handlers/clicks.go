@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+const (
+	clickBufferSize    = 1024
+	clickBatchSize     = 100
+	clickFlushInterval = time.Second
+	clickFlushTimeout  = 5 * time.Second
+
+	maxUserAgentLength = 512
+	maxReferrerLength  = 2048
+	ipv4AnonymizedBits = 24
+	ipv6AnonymizedBits = 48
+)
+
+const (
+	statsDaysQueryParam = "days"
+	defaultStatsDays    = 30
+	maxStatsDays        = 365
+	statsTopReferrers   = 10
+)
+
+// ClickRecorder асинхронно пишет события переходов пачками.
+// Если буфер переполнен, событие отбрасывается, чтобы не задерживать редирект
+type ClickRecorder struct {
+	clicks chan models.Click
+	flush  func(ctx context.Context, clicks []models.Click) error
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+func NewClickRecorder(flush func(ctx context.Context, clicks []models.Click) error) *ClickRecorder {
+	cr := &ClickRecorder{
+		clicks: make(chan models.Click, clickBufferSize),
+		flush:  flush,
+		done:   make(chan struct{}),
+	}
+	cr.wg.Add(1)
+	go cr.run()
+	return cr
+}
+
+func (cr *ClickRecorder) Record(ctx context.Context, click models.Click) {
+	select {
+	case <-cr.done:
+		return
+	default:
+	}
+
+	select {
+	case cr.clicks <- click:
+	default:
+		logger.FromContext(ctx).Warn("Click buffer is full, click dropped", zap.String("short_url", click.ShortURL))
+	}
+}
+
+func (cr *ClickRecorder) run() {
+	defer cr.wg.Done()
+
+	ticker := time.NewTicker(clickFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]models.Click, 0, clickBatchSize)
+	for {
+		select {
+		case click := <-cr.clicks:
+			batch = append(batch, click)
+			if len(batch) >= clickBatchSize {
+				batch = cr.write(batch)
+			}
+		case <-ticker.C:
+			batch = cr.write(batch)
+		case <-cr.done:
+			// дописываем то, что успело попасть в буфер
+			for {
+				select {
+				case click := <-cr.clicks:
+					batch = append(batch, click)
+					if len(batch) >= clickBatchSize {
+						batch = cr.write(batch)
+					}
+				default:
+					cr.write(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (cr *ClickRecorder) write(batch []models.Click) []models.Click {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clickFlushTimeout)
+	defer cancel()
+	if err := cr.flush(ctx, batch); err != nil {
+		logger.Log.Error("Error saving clicks", zap.Error(err), zap.Int("count", len(batch)))
+	}
+	return batch[:0]
+}
+
+// Close прекращает прием событий и дожидается записи буфера
+func (cr *ClickRecorder) Close() {
+	cr.once.Do(func() {
+		close(cr.done)
+	})
+	cr.wg.Wait()
+}
+
+// saveClicks пишет пачку событий в хранилище и в файл
+func (us *URLShortener) saveClicks(ctx context.Context, clicks []models.Click) error {
+	if err := us.Storage.SaveClicks(ctx, clicks); err != nil {
+		return err
+	}
+	if us.fileStorage != nil {
+		return us.fileOp(ctx, "save_clicks", func() error { return us.fileStorage.SaveClicks(clicks) })
+	}
+	return nil
+}
+
+func (us *URLShortener) StopClickRecorder() {
+	us.clickRecorder.Close()
+}
+
+func newClick(r *http.Request, shortURL string) models.Click {
+	return models.Click{
+		ShortURL:  shortURL,
+		ClickedAt: time.Now().UTC(),
+		Referrer:  truncate(r.Referer(), maxReferrerLength),
+		UserAgent: truncate(r.UserAgent(), maxUserAgentLength),
+		IP:        anonymizeIP(clientIP(r)),
+	}
+}
+
+// truncate обрезает заголовок до maxLen байт по границе символа. Невалидный UTF-8 отбрасывается:
+// PostgreSQL не примет такую строку, и вместе с ней пропадет вся пачка переходов
+func truncate(s string, maxLen int) string {
+	s = strings.ToValidUTF8(s, "")
+	if len(s) <= maxLen {
+		return s
+	}
+	for maxLen > 0 && !utf8.RuneStart(s[maxLen]) {
+		maxLen--
+	}
+	return s[:maxLen]
+}
+
+// clientIP определяет адрес клиента с учетом прокси
+func clientIP(r *http.Request) string {
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return strings.TrimSpace(realIP)
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// anonymizeIP обнуляет младшие биты адреса: последний октет IPv4 и все, кроме /48, для IPv6
+func anonymizeIP(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(ipv4AnonymizedBits, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6AnonymizedBits, 128)).String()
+}
+
+// ClickStatsHandler отдает статистику переходов по ссылке владельцу ссылки
+func (us *URLShortener) ClickStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
+
+	days := defaultStatsDays
+	if daysParam := r.URL.Query().Get(statsDaysQueryParam); daysParam != "" {
+		var err error
+		days, err = strconv.Atoi(daysParam)
+		if err != nil || days <= 0 || days > maxStatsDays {
+			http.Error(w, "invalid days parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	shortURL := chi.URLParam(r, "id")
+	url, err := us.Storage.GetURL(r.Context(), shortURL)
+	// чужие ссылки не отличаются от несуществующих
+	if errors.Is(err, storage.ErrURLNotFound) || (err == nil && url.UserID != userID) {
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error get URL from storage", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+	stats, err := us.Storage.GetClickStats(r.Context(), shortURL, since, statsTopReferrers)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error get click stats", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	stats.ShortURL = us.buildShortURL(shortURL)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClickTruncatesHeaders(t *testing.T) {
+	// кириллица занимает два байта, граница maxReferrerLength приходится на середину символа
+	referrer := "https://пример.рф/a" + strings.Repeat("ы", maxReferrerLength)
+	request := httptest.NewRequest("GET", "/abc", nil)
+	request.Header.Set("Referer", referrer)
+	request.Header.Set("User-Agent", "агент\xff"+strings.Repeat("ю", maxUserAgentLength))
+
+	click := newClick(request, "abc")
+	assert.True(t, utf8.ValidString(click.Referrer))
+	assert.LessOrEqual(t, len(click.Referrer), maxReferrerLength)
+	assert.True(t, strings.HasPrefix(referrer, click.Referrer))
+	assert.Equal(t, maxReferrerLength-1, len(click.Referrer))
+	assert.True(t, utf8.ValidString(click.UserAgent))
+	assert.LessOrEqual(t, len(click.UserAgent), maxUserAgentLength)
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      string
+		maxLen int
+		want   string
+	}{
+		{name: "Short", s: "abc", maxLen: 5, want: "abc"},
+		{name: "ASCII", s: "abcdef", maxLen: 3, want: "abc"},
+		{name: "RuneBoundary", s: "яяя", maxLen: 4, want: "яя"},
+		{name: "MiddleOfRune", s: "яяя", maxLen: 3, want: "я"},
+		{name: "InvalidUTF8", s: "a\xffb", maxLen: 5, want: "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, truncate(tt.s, tt.maxLen))
+		})
+	}
+}
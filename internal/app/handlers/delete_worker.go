@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDeleteWorkers       = 2
+	defaultDeleteBatchSize     = 100
+	defaultDeleteFlushInterval = time.Second
+
+	deleteMaxAttempts  = 3
+	deleteRetryBackoff = 100 * time.Millisecond
+	deleteFlushTimeout = 10 * time.Second
+)
+
+var ErrDeleteQueueClosed = errors.New("delete queue is closed")
+
+type deleteRequest struct {
+	UserID int
+	URL    string
+	// RequestID и SpanContext запроса, поставившего URL в очередь, чтобы удаление можно было найти в логах и трассах
+	RequestID   string
+	SpanContext trace.SpanContext
+}
+
+// userDeletions URL пользователя в пачке и запросы, которые поставили их в очередь
+type userDeletions struct {
+	shortURLs  []string
+	requestIDs []string
+	links      []trace.Link
+}
+
+func (d *userDeletions) add(req deleteRequest) {
+	d.shortURLs = append(d.shortURLs, req.URL)
+	// URL одного запроса приходят подряд, поэтому достаточно сравнить с последним
+	if req.RequestID != "" && (len(d.requestIDs) == 0 || d.requestIDs[len(d.requestIDs)-1] != req.RequestID) {
+		d.requestIDs = append(d.requestIDs, req.RequestID)
+	}
+	if req.SpanContext.IsValid() && (len(d.links) == 0 || !d.links[len(d.links)-1].SpanContext.Equal(req.SpanContext)) {
+		d.links = append(d.links, trace.Link{SpanContext: req.SpanContext})
+	}
+}
+
+// deleteWorkers пул обработчиков deleteCh, живущий все время работы сервиса
+type deleteWorkers struct {
+	batchSize     int
+	flushInterval time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func (us *URLShortener) startDeleteWorkers(workers, batchSize int, flushInterval time.Duration) {
+	if workers <= 0 {
+		workers = defaultDeleteWorkers
+	}
+	if batchSize <= 0 {
+		batchSize = defaultDeleteBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultDeleteFlushInterval
+	}
+	us.deleteWorkers.batchSize = batchSize
+	us.deleteWorkers.flushInterval = flushInterval
+
+	for i := 0; i < workers; i++ {
+		us.deleteWorkers.wg.Add(1)
+		go us.ProcessDeletedURLs()
+	}
+}
+
+// enqueueDeletion передает URL пользователя в очередь на удаление.
+// Если очередь заполнена, ждет освобождения места или отмены ctx
+func (us *URLShortener) enqueueDeletion(ctx context.Context, userID int, shortURLs []string) error {
+	us.deleteWorkers.mu.RLock()
+	defer us.deleteWorkers.mu.RUnlock()
+
+	if us.deleteWorkers.closed {
+		return ErrDeleteQueueClosed
+	}
+	requestID := logger.RequestIDFromContext(ctx)
+	spanContext := trace.SpanContextFromContext(ctx)
+	for _, shortURL := range shortURLs {
+		select {
+		case us.deleteCh <- deleteRequest{UserID: userID, URL: shortURL, RequestID: requestID, SpanContext: spanContext}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// ProcessDeletedURLs копит запросы из deleteCh и удаляет их пачками по пользователям,
+// когда набрался batchSize или прошел flushInterval. Завершается после закрытия deleteCh
+func (us *URLShortener) ProcessDeletedURLs() {
+	defer us.deleteWorkers.wg.Done()
+
+	ticker := time.NewTicker(us.deleteWorkers.flushInterval)
+	defer ticker.Stop()
+
+	batch := make(map[int]*userDeletions)
+	size := 0
+	flush := func() {
+		if size == 0 {
+			return
+		}
+		us.flushDeletions(batch)
+		batch = make(map[int]*userDeletions)
+		size = 0
+	}
+
+	for {
+		select {
+		case req, ok := <-us.deleteCh:
+			if !ok {
+				flush()
+				return
+			}
+			deletions, ok := batch[req.UserID]
+			if !ok {
+				deletions = &userDeletions{}
+				batch[req.UserID] = deletions
+			}
+			deletions.add(req)
+			size++
+			if size >= us.deleteWorkers.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (us *URLShortener) flushDeletions(batch map[int]*userDeletions) {
+	ctx, cancel := context.WithTimeout(context.Background(), deleteFlushTimeout)
+	defer cancel()
+
+	for userID, deletions := range batch {
+		// логгер с id исходных запросов, его же используют хранилища
+		log := logger.Log.With(zap.Strings("request_ids", deletions.requestIDs), zap.Int("user_id", userID))
+		// пачка обрабатывается вне запросов, поэтому спан корневой и ссылается на спаны запросов
+		userCtx, span := tracing.Start(logger.WithLogger(ctx, log), "delete_batch",
+			trace.WithNewRoot(),
+			trace.WithLinks(deletions.links...),
+			trace.WithAttributes(
+				attribute.Int("user.id", userID),
+				attribute.Int("urls.count", len(deletions.shortURLs)),
+				attribute.StringSlice("request.ids", deletions.requestIDs),
+			),
+		)
+		err := us.markDeletedWithRetry(userCtx, userID, deletions.shortURLs)
+		tracing.End(span, err)
+		if err != nil {
+			log.Error("Error marking URLs as deleted", zap.Error(err), zap.Strings("urls", deletions.shortURLs))
+			continue
+		}
+		log.Debug("URLs marked as deleted", zap.Strings("urls", deletions.shortURLs))
+	}
+}
+
+func (us *URLShortener) markDeletedWithRetry(ctx context.Context, userID int, shortURLs []string) error {
+	var err error
+	backoff := deleteRetryBackoff
+	for attempt := 1; attempt <= deleteMaxAttempts; attempt++ {
+		err = us.markDeleted(ctx, userID, shortURLs)
+		if err == nil || !storage.IsTransientError(err) || attempt == deleteMaxAttempts {
+			break
+		}
+		logger.FromContext(ctx).Warn("Retrying URLs deletion", zap.Error(err), zap.Int("attempt", attempt))
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (us *URLShortener) markDeleted(ctx context.Context, userID int, shortURLs []string) error {
+	if err := us.Storage.MarkURLAsDeleted(ctx, userID, shortURLs); err != nil {
+		return err
+	}
+	if us.fileStorage != nil {
+		return us.fileOp(ctx, "mark_url_as_deleted", func() error { return us.fileStorage.MarkURLAsDeleted(userID, shortURLs) })
+	}
+	return nil
+}
+
+// DeleteQueueLen число запросов, ожидающих в очереди удаления
+func (us *URLShortener) DeleteQueueLen() int {
+	return len(us.deleteCh)
+}
+
+func (us *URLShortener) DeleteQueueCap() int {
+	return cap(us.deleteCh)
+}
+
+// StopDeleteWorkers закрывает очередь удаления и дожидается обработки всех запросов
+func (us *URLShortener) StopDeleteWorkers() {
+	us.deleteWorkers.mu.Lock()
+	if !us.deleteWorkers.closed {
+		us.deleteWorkers.closed = true
+		close(us.deleteCh)
+	}
+	us.deleteWorkers.mu.Unlock()
+
+	us.deleteWorkers.wg.Wait()
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/logger"
+	"go.uber.org/zap"
+)
+
+var ErrExpirationInvalid = errors.New("invalid link expiration")
+
+// maxExpiration наибольший срок жизни ссылки. Больший ttl_seconds переполнил бы time.Duration
+const maxExpiration = 100 * 365 * 24 * time.Hour
+
+// expirationTime вычисляет момент истечения ссылки из абсолютного expires_at или ttl_seconds.
+// Нулевое время означает бессрочную ссылку
+func expirationTime(expiresAt *time.Time, ttlSeconds int64, now time.Time) (time.Time, error) {
+	switch {
+	case expiresAt != nil && ttlSeconds != 0:
+		return time.Time{}, fmt.Errorf("%w: expires_at and ttl_seconds are mutually exclusive", ErrExpirationInvalid)
+	case ttlSeconds < 0:
+		return time.Time{}, fmt.Errorf("%w: ttl_seconds must be positive", ErrExpirationInvalid)
+	case ttlSeconds > int64(maxExpiration/time.Second):
+		return time.Time{}, fmt.Errorf("%w: ttl_seconds must not exceed %d", ErrExpirationInvalid, int64(maxExpiration/time.Second))
+	case ttlSeconds > 0:
+		return now.Add(time.Duration(ttlSeconds) * time.Second).UTC(), nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return time.Time{}, fmt.Errorf("%w: expires_at must be in the future", ErrExpirationInvalid)
+		}
+		if expiresAt.After(now.Add(maxExpiration)) {
+			return time.Time{}, fmt.Errorf("%w: expires_at must be within %d seconds", ErrExpirationInvalid, int64(maxExpiration/time.Second))
+		}
+		return expiresAt.UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// RunExpiredURLsReaper периодически удаляет ссылки, истекшие более retention назад.
+// Работает до отмены ctx
+func (us *URLShortener) RunExpiredURLsReaper(ctx context.Context, interval, retention time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := us.ReapExpiredURLs(ctx, time.Now().Add(-retention)); err != nil {
+				logger.FromContext(ctx).Error("Error reaping expired URLs", zap.Error(err))
+			}
+		}
+	}
+}
+
+// ReapExpiredURLs удаляет ссылки, истекшие раньше before, из хранилища и файла
+func (us *URLShortener) ReapExpiredURLs(ctx context.Context, before time.Time) error {
+	deleteURLs := func() ([]string, error) {
+		return us.Storage.DeleteExpiredURLs(ctx, before)
+	}
+	var deleted []string
+	var err error
+	if us.fileStorage != nil {
+		err = us.fileOp(ctx, "purge_urls", func() error {
+			var purgeErr error
+			deleted, purgeErr = us.fileStorage.PurgeURLs(deleteURLs)
+			return purgeErr
+		})
+	} else {
+		deleted, err = deleteURLs()
+	}
+	if err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+	logger.FromContext(ctx).Info("Expired URLs reaped", zap.Int("count", len(deleted)))
+	return nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Tokebay/yandex/config"
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpirationTime(t *testing.T) {
+	now := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+	expiresAt := func(d time.Duration) *time.Time {
+		at := now.Add(d)
+		return &at
+	}
+	maxTTL := int64(maxExpiration / time.Second)
+
+	tests := []struct {
+		name       string
+		expiresAt  *time.Time
+		ttlSeconds int64
+		want       time.Time
+		wantErr    bool
+	}{
+		{name: "Permanent"},
+		{name: "TTL", ttlSeconds: 60, want: now.Add(time.Minute)},
+		{name: "MaxTTL", ttlSeconds: maxTTL, want: now.Add(maxExpiration)},
+		{name: "ExpiresAt", expiresAt: expiresAt(time.Hour), want: now.Add(time.Hour)},
+		{name: "NegativeTTL", ttlSeconds: -1, wantErr: true},
+		{name: "Both", expiresAt: expiresAt(time.Hour), ttlSeconds: 60, wantErr: true},
+		{name: "ExpiresAtInPast", expiresAt: expiresAt(-time.Hour), wantErr: true},
+		// без ограничения time.Duration переполняется и срок оказывается в прошлом
+		{name: "TTLTooLong", ttlSeconds: maxTTL + 1, wantErr: true},
+		{name: "TTLOverflow", ttlSeconds: math.MaxInt64, wantErr: true},
+		{name: "ExpiresAtTooFar", expiresAt: expiresAt(maxExpiration + time.Second), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expirationTime(tt.expiresAt, tt.ttlSeconds, now)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrExpirationInvalid)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReapExpiredURLsReuseAlias(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+	fileStorage, err := NewProducer(filePath)
+	require.NoError(t, err)
+	mapStorage := storage.NewMapStorage()
+	us := NewURLShortener(&config.Config{}, mapStorage, fileStorage)
+	defer us.StopDeleteWorkers()
+	ctx := context.Background()
+
+	expiresAt := time.Now().Add(-time.Hour).UTC()
+	require.NoError(t, mapStorage.SaveURL(ctx, models.ShortenURL{ShortURL: "alias", OriginalURL: "https://ya.ru/", UserID: 1, ExpiresAt: expiresAt}))
+	require.NoError(t, fileStorage.SaveToFileURL(&URLData{UUID: 1, ShortURL: "alias", OriginalURL: "https://ya.ru/", UserID: 1, ExpiresAt: &expiresAt}))
+	require.NoError(t, us.ReapExpiredURLs(ctx, time.Now()))
+
+	// освободившийся псевдоним занимает новая ссылка, после перезапуска она на месте
+	require.NoError(t, mapStorage.SaveURL(ctx, models.ShortenURL{ShortURL: "alias", OriginalURL: "https://mail.ru/", UserID: 2}))
+	require.NoError(t, fileStorage.SaveToFileURL(&URLData{UUID: 2, ShortURL: "alias", OriginalURL: "https://mail.ru/", UserID: 2}))
+	require.NoError(t, fileStorage.Close())
+
+	fileStorage, err = NewProducer(filePath)
+	require.NoError(t, err)
+	defer fileStorage.Close()
+	data, err := fileStorage.LoadInitialData()
+	require.NoError(t, err)
+	assert.Equal(t, []URLData{{UUID: 2, ShortURL: "alias", OriginalURL: "https://mail.ru/", UserID: 2}}, data)
+}
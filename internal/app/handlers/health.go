@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"go.uber.org/zap"
+)
+
+// readinessTimeout ограничивает каждую проверку готовности, чтобы зависшая база не держала пробу
+const readinessTimeout = 2 * time.Second
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// AddReadinessCheck добавляет компонент в /readyz. Проверка не должна менять данные
+func (us *URLShortener) AddReadinessCheck(name string, check func(ctx context.Context) error) {
+	us.readinessChecks = append(us.readinessChecks, readinessCheck{name: name, check: check})
+}
+
+// defaultReadinessChecks хранилище через существующий пул и, если есть, файл журнала
+func (us *URLShortener) defaultReadinessChecks() {
+	us.AddReadinessCheck("storage", us.Storage.Ping)
+	if us.fileStorage != nil {
+		us.AddReadinessCheck("file_storage", func(context.Context) error {
+			return us.fileStorage.CheckWritable()
+		})
+	}
+}
+
+// HealthzHandler отвечает 200, пока процесс жив. Внешние зависимости не проверяются
+func (us *URLShortener) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, models.HealthResponse{Status: models.HealthStatusOK})
+}
+
+// ReadyzHandler отвечает 200, если все компоненты доступны, иначе 503
+func (us *URLShortener) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp, ready := us.readiness(r.Context())
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
+
+// CheckDBConnect /ping, оставлен для совместимости: те же проверки, что /readyz, но при ошибке 500
+func (us *URLShortener) CheckDBConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp, ready := us.readiness(r.Context())
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusInternalServerError
+	}
+	writeHealth(w, status, resp)
+}
+
+func (us *URLShortener) readiness(ctx context.Context) (models.HealthResponse, bool) {
+	resp := models.HealthResponse{
+		Status:     models.HealthStatusOK,
+		Components: make(map[string]models.ComponentStatus, len(us.readinessChecks)),
+	}
+	ready := true
+	for _, c := range us.readinessChecks {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		err := c.check(checkCtx)
+		cancel()
+
+		if err != nil {
+			logger.FromContext(ctx).Warn("Readiness check failed", zap.String("component", c.name), zap.Error(err))
+			resp.Components[c.name] = models.ComponentStatus{Status: models.HealthStatusUnavailable, Error: err.Error()}
+			resp.Status = models.HealthStatusUnavailable
+			ready = false
+			continue
+		}
+		resp.Components[c.name] = models.ComponentStatus{Status: models.HealthStatusOK}
+	}
+	return resp, ready
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp models.HealthResponse) {
+	// пробы не должны кешироваться прокси
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
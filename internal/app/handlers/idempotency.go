@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader отмечает ответ, повторенный из сохраненного
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+	// idempotencyRetryAfter через сколько секунд повторить запрос, пока первый еще выполняется
+	idempotencyRetryAfter = 1
+)
+
+// IdempotencyMiddleware повторяет сохраненный ответ на запрос с тем же Idempotency-Key.
+// Ключ действует в пределах пользователя, поэтому middleware ставится после Authenticate.
+// Тот же ключ с другим запросом — 422, пока первый запрос выполняется — 409.
+// Ответы 5xx не сохраняются: после сбоя запрос можно повторить с тем же ключом
+func (us *URLShortener) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		ttl := us.config.IdempotencyTTL
+		if key == "" || ttl <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			http.Error(w, "invalid Idempotency-Key", http.StatusBadRequest)
+			return
+		}
+		identity, ok := requireIdentity(w, r)
+		if !ok {
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "error reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now().UTC()
+		record := models.IdempotencyRecord{
+			UserID:      identity.UserID,
+			Key:         key,
+			RequestHash: requestHash(r, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(ttl),
+		}
+		existing, err := us.Storage.ReserveIdempotencyKey(r.Context(), record)
+		if errors.Is(err, storage.ErrIdempotencyKeyExists) {
+			replayIdempotentResponse(w, record, existing)
+			return
+		}
+		if err != nil {
+			logger.FromContext(r.Context()).Error("Error reserving idempotency key", zap.Error(err))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// клиент, ради которого ключ и нужен, мог уже отключиться, а ответ сохранить надо
+		ctx := detachedContext(r.Context())
+		recorder := &responseRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			// паника или сбой — освобождаем ключ
+			if err := us.Storage.DeleteIdempotencyKey(ctx, record.UserID, record.Key); err != nil {
+				logger.FromContext(ctx).Error("Error releasing idempotency key", zap.Error(err))
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status() >= http.StatusInternalServerError {
+			return
+		}
+		record.StatusCode = recorder.status()
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.Body = recorder.body.Bytes()
+		if err := us.Storage.CompleteIdempotencyKey(ctx, record); err != nil {
+			logger.FromContext(ctx).Error("Error saving idempotent response", zap.Error(err))
+			return
+		}
+		completed = true
+		if us.fileStorage != nil {
+			err := us.fileOp(ctx, "save_idempotency_record", func() error { return us.fileStorage.SaveIdempotencyRecord(record) })
+			if err != nil {
+				// ответ уже отдан и повторяется до перезапуска
+				logger.FromContext(ctx).Error("Error saving idempotent response to file", zap.Error(err))
+			}
+		}
+	})
+}
+
+// maxIdempotencyCleanupInterval при большом IdempotencyTTL истекшие ответы все равно удаляются не реже раза в час
+const maxIdempotencyCleanupInterval = time.Hour
+
+// RunIdempotencyKeysCleaner периодически удаляет истекшие ответы на запросы с Idempotency-Key
+// из хранилища и файла. Интервал — ttl, но не больше часа. Работает до отмены ctx
+func (us *URLShortener) RunIdempotencyKeysCleaner(ctx context.Context, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	interval := ttl
+	if interval > maxIdempotencyCleanupInterval {
+		interval = maxIdempotencyCleanupInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := us.DeleteExpiredIdempotencyKeys(ctx, time.Now()); err != nil {
+				logger.FromContext(ctx).Error("Error deleting expired idempotency keys", zap.Error(err))
+			}
+		}
+	}
+}
+
+// DeleteExpiredIdempotencyKeys удаляет ответы, истекшие раньше before, из хранилища и файла
+func (us *URLShortener) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) error {
+	n, err := us.Storage.DeleteExpiredIdempotencyKeys(ctx, before)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	if us.fileStorage != nil {
+		err := us.fileOp(ctx, "purge_idempotency_records", func() error {
+			return us.fileStorage.PurgeExpiredIdempotencyRecords(before)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	logger.FromContext(ctx).Debug("Expired idempotency keys deleted", zap.Int("count", n))
+	return nil
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, record, existing models.IdempotencyRecord) {
+	switch {
+	case existing.RequestHash != record.RequestHash:
+		http.Error(w, "Idempotency-Key is already used with a different request", http.StatusUnprocessableEntity)
+	case !existing.IsCompleted():
+		w.Header().Set("Retry-After", strconv.Itoa(idempotencyRetryAfter))
+		http.Error(w, "request with this Idempotency-Key is in progress", http.StatusConflict)
+	default:
+		if existing.ContentType != "" {
+			w.Header().Set("Content-Type", existing.ContentType)
+		}
+		w.Header().Set(IdempotentReplayedHeader, "true")
+		w.WriteHeader(existing.StatusCode)
+		w.Write(existing.Body)
+	}
+}
+
+// validIdempotencyKey ключ из печатных ASCII-символов
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHash отличает запросы с одним ключом: путь и параметры входят в хеш, так как алиас в POST / передается в query
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// detachedContext не отменяется вместе с запросом, но сохраняет его логгер и трассу
+func detachedContext(ctx context.Context) context.Context {
+	detached := logger.WithLogger(context.Background(), logger.FromContext(ctx))
+	return trace.ContextWithSpanContext(detached, trace.SpanContextFromContext(ctx))
+}
+
+// responseRecorder передает ответ клиенту и запоминает его для повтора
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if rr.statusCode == 0 {
+		rr.statusCode = code
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	if rr.statusCode == 0 {
+		rr.statusCode = http.StatusOK
+	}
+	rr.body.Write(data)
+	return rr.ResponseWriter.Write(data)
+}
+
+func (rr *responseRecorder) status() int {
+	if rr.statusCode == 0 {
+		return http.StatusOK
+	}
+	return rr.statusCode
+}
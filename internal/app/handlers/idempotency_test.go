@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Tokebay/yandex/config"
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunIdempotencyKeysCleaner(t *testing.T) {
+	fileStorage, err := NewProducer(filepath.Join(t.TempDir(), "short-url-db.json"))
+	require.NoError(t, err)
+	defer fileStorage.Close()
+	mapStorage := storage.NewMapStorage()
+	// очистка не зависит от удаления истекших ссылок, которое здесь выключено
+	us := NewURLShortener(&config.Config{IdempotencyTTL: 20 * time.Millisecond}, mapStorage, fileStorage)
+	defer us.StopDeleteWorkers()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	now := time.Now()
+	record := models.IdempotencyRecord{UserID: 1, Key: "k", RequestHash: "hash", StatusCode: 201, CreatedAt: now,
+		ExpiresAt: now.Add(us.config.IdempotencyTTL)}
+	require.NoError(t, mapStorage.CompleteIdempotencyKey(ctx, record))
+	require.NoError(t, fileStorage.SaveIdempotencyRecord(record))
+
+	go us.RunIdempotencyKeysCleaner(ctx, us.config.IdempotencyTTL)
+
+	assert.Eventually(t, func() bool {
+		records, err := fileStorage.LoadIdempotencyRecords(time.Time{})
+		return err == nil && len(records) == 0
+	}, time.Second, 10*time.Millisecond)
+	n, err := mapStorage.DeleteExpiredIdempotencyKeys(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Tokebay/yandex/config"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+var ErrUnknownKeyID = errors.New("unknown key id")
+var ErrKeyConfig = errors.New("invalid signing key config")
+
+// verifyKey ключ проверки подписи вместе с алгоритмом, которым он может пользоваться
+type verifyKey struct {
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+// KeySet набор ключей токенов: новые токены подписываются активным ключом,
+// проверка принимает любой известный ключ по заголовку kid
+type KeySet struct {
+	activeID string
+	method   jwt.SigningMethod
+	signKey  interface{}
+	verifyBy map[string]verifyKey
+}
+
+var (
+	keySetMu sync.RWMutex
+	// по умолчанию случайный секрет: токены не переживут перезапуск, но их нельзя подделать
+	keySet = NewHMACKeySet("", randomSecret())
+)
+
+// SetKeySet заменяет ключи, которыми подписываются и проверяются токены
+func SetKeySet(ks *KeySet) {
+	keySetMu.Lock()
+	defer keySetMu.Unlock()
+	keySet = ks
+}
+
+func currentKeySet() *KeySet {
+	keySetMu.RLock()
+	defer keySetMu.RUnlock()
+	return keySet
+}
+
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+func NewHMACKeySet(id string, secret []byte) *KeySet {
+	ks := &KeySet{
+		activeID: id,
+		method:   jwt.SigningMethodHS256,
+		signKey:  secret,
+		verifyBy: make(map[string]verifyKey),
+	}
+	ks.verifyBy[id] = verifyKey{method: jwt.SigningMethodHS256, key: secret}
+	return ks
+}
+
+// NewAsymmetricKeySet подписывает токены закрытым ключом Ed25519 (EdDSA) или RSA (RS256) в формате PEM
+func NewAsymmetricKeySet(id, alg string, privatePEM []byte) (*KeySet, error) {
+	ks := &KeySet{activeID: id, verifyBy: make(map[string]verifyKey)}
+	switch alg {
+	case AlgEdDSA:
+		key, err := jwt.ParseEdPrivateKeyFromPEM(privatePEM)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrKeyConfig, err)
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected Ed25519 key type %T", ErrKeyConfig, key)
+		}
+		ks.method = jwt.SigningMethodEdDSA
+		ks.signKey = edKey
+		ks.verifyBy[id] = verifyKey{method: jwt.SigningMethodEdDSA, key: edKey.Public()}
+	case AlgRS256:
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrKeyConfig, err)
+		}
+		ks.method = jwt.SigningMethodRS256
+		ks.signKey = key
+		ks.verifyBy[id] = verifyKey{method: jwt.SigningMethodRS256, key: &key.PublicKey}
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrKeyConfig, alg)
+	}
+	return ks, nil
+}
+
+// AddHMACKey добавляет старый секрет, которым еще можно проверять выданные токены
+func (ks *KeySet) AddHMACKey(id string, secret []byte) error {
+	if _, ok := ks.verifyBy[id]; ok {
+		return fmt.Errorf("%w: duplicate key id %q", ErrKeyConfig, id)
+	}
+	ks.verifyBy[id] = verifyKey{method: jwt.SigningMethodHS256, key: secret}
+	return nil
+}
+
+// AddPublicKey добавляет открытый ключ Ed25519 или RSA в формате PEM для проверки выданных токенов
+func (ks *KeySet) AddPublicKey(id string, publicPEM []byte) error {
+	if _, ok := ks.verifyBy[id]; ok {
+		return fmt.Errorf("%w: duplicate key id %q", ErrKeyConfig, id)
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(publicPEM); err == nil {
+		ks.verifyBy[id] = verifyKey{method: jwt.SigningMethodEdDSA, key: key}
+		return nil
+	}
+	key, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+	if err != nil {
+		return fmt.Errorf("%w: key %q is neither Ed25519 nor RSA public key", ErrKeyConfig, id)
+	}
+	ks.verifyBy[id] = verifyKey{method: jwt.SigningMethodRS256, key: key}
+	return nil
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.method, claims)
+	if ks.activeID != "" {
+		token.Header["kid"] = ks.activeID
+	}
+	return token.SignedString(ks.signKey)
+}
+
+// keyFunc выбирает ключ по kid. Токены без kid выданы до ротации и проверяются активным ключом
+func (ks *KeySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	id := ks.activeID
+	if kid, ok := t.Header["kid"]; ok {
+		s, ok := kid.(string)
+		if !ok {
+			return nil, ErrUnknownKeyID
+		}
+		id = s
+	}
+	key, ok := ks.verifyBy[id]
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+	// алгоритм определяется ключом, а не заголовком токена
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	return key.key, nil
+}
+
+// LoadKeySet собирает ключи токенов из настроек
+func LoadKeySet(cfg *config.Config) (*KeySet, error) {
+	var ks *KeySet
+	switch cfg.JWTAlgorithm {
+	case "", AlgHS256:
+		secret := []byte(cfg.JWTSecret)
+		if len(secret) == 0 {
+			secret = randomSecret()
+		}
+		ks = NewHMACKeySet(cfg.JWTKeyID, secret)
+	default:
+		privatePEM, err := os.ReadFile(cfg.JWTPrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: read private key: %s", ErrKeyConfig, err)
+		}
+		ks, err = NewAsymmetricKeySet(cfg.JWTKeyID, cfg.JWTAlgorithm, privatePEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	previous, err := parseKeyList(cfg.JWTPreviousSecrets)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range previous {
+		if err := ks.AddHMACKey(kv[0], []byte(kv[1])); err != nil {
+			return nil, err
+		}
+	}
+
+	publicKeys, err := parseKeyList(cfg.JWTPublicKeys)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range publicKeys {
+		publicPEM, err := os.ReadFile(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: read public key %q: %s", ErrKeyConfig, kv[0], err)
+		}
+		if err := ks.AddPublicKey(kv[0], publicPEM); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+// parseKeyList разбирает список вида "kid:value,kid:value"
+func parseKeyList(list string) ([][2]string, error) {
+	var result [][2]string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, value, ok := strings.Cut(item, ":")
+		if !ok || id == "" || value == "" {
+			return nil, fmt.Errorf("%w: expected kid:value, got %q", ErrKeyConfig, item)
+		}
+		result = append(result, [2]string{id, value})
+	}
+	return result, nil
+}
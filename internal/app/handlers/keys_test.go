@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withKeySet(t *testing.T, ks *KeySet) {
+	old := currentKeySet()
+	SetKeySet(ks)
+	t.Cleanup(func() { SetKeySet(old) })
+}
+
+func TestKeySet_rotation(t *testing.T) {
+	withKeySet(t, NewHMACKeySet("old", []byte("old-secret")))
+	oldToken, err := BuildJWTString(42)
+	require.NoError(t, err)
+
+	rotated := NewHMACKeySet("new", []byte("new-secret"))
+	require.NoError(t, rotated.AddHMACKey("old", []byte("old-secret")))
+	SetKeySet(rotated)
+
+	userID, err := ExtractUserIDFromToken(oldToken)
+	require.NoError(t, err)
+	assert.Equal(t, 42, userID)
+
+	newToken, err := BuildJWTString(7)
+	require.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "new", parsed.Header["kid"])
+
+	// после удаления старого ключа выданные им токены не принимаются
+	SetKeySet(NewHMACKeySet("new", []byte("new-secret")))
+	_, err = ExtractUserIDFromToken(oldToken)
+	assert.Error(t, err)
+}
+
+func TestKeySet_forgedToken(t *testing.T) {
+	withKeySet(t, NewHMACKeySet("1", []byte("server-secret")))
+
+	forged, err := NewHMACKeySet("1", []byte("shortURL")).sign(Claims{UserID: 1})
+	require.NoError(t, err)
+	_, err = ExtractUserIDFromToken(forged)
+	assert.Error(t, err)
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, Claims{UserID: 1}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = ExtractUserIDFromToken(unsigned)
+	assert.Error(t, err)
+}
+
+func TestKeySet_EdDSA(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+
+	ks, err := NewAsymmetricKeySet("ed", AlgEdDSA, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}))
+	require.NoError(t, err)
+	withKeySet(t, ks)
+
+	token, err := BuildJWTString(5)
+	require.NoError(t, err)
+
+	// другой сервис проверяет токен только открытым ключом
+	verifier := NewHMACKeySet("other", []byte("unused"))
+	require.NoError(t, verifier.AddPublicKey("ed", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})))
+	claims := &Claims{}
+	_, err = jwt.ParseWithClaims(token, claims, verifier.keyFunc)
+	require.NoError(t, err)
+	assert.Equal(t, 5, claims.UserID)
+}
@@ -1,77 +1,701 @@
 package handlers
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
 	"go.uber.org/zap"
 )
 
+// Типы записей журнала. Записи без типа (старый формат файла) считаются recordCreate
+const (
+	recordCreate = "create"
+	recordUpdate = "update"
+	recordDelete = "delete"
+	recordPurge  = "purge"
+	recordRevoke = "revoke"
+	// recordMerge передает записи пользователя from_user_id пользователю user_id
+	recordMerge = "merge"
+)
+
+// SyncPolicy определяет, когда журнал сбрасывается на диск через fsync
+type SyncPolicy int
+
+const (
+	// SyncNone полагается на сброс данных операционной системой
+	SyncNone SyncPolicy = iota
+	// SyncAlways вызывает fsync после каждой записи
+	SyncAlways
+	// SyncInterval вызывает fsync в фоне не чаще заданного интервала
+	SyncInterval
+)
+
+var ErrUnknownSyncPolicy = errors.New("unknown file sync policy")
+var ErrCorruptedFile = errors.New("storage file is corrupted")
+
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch policy {
+	case "none":
+		return SyncNone, nil
+	case "always":
+		return SyncAlways, nil
+	case "interval", "":
+		return SyncInterval, nil
+	}
+	return SyncNone, fmt.Errorf("%w: %s", ErrUnknownSyncPolicy, policy)
+}
+
+const (
+	defaultSyncInterval = time.Second
+	compactTmpSuffix    = ".tmp"
+	// clicksSuffix файл событий переходов лежит рядом с журналом URL
+	clicksSuffix = ".clicks"
+	// apiKeysSuffix журнал ключей доступа: create и revoke
+	apiKeysSuffix = ".keys"
+	// usersSuffix журнал учетных записей: каждая запись — актуальное состояние пользователя.
+	// Запись без email — резерв идентификаторов анонимных пользователей до ее id
+	usersSuffix = ".users"
+	// idempotencySuffix ответы на запросы с Idempotency-Key. Сохраняются только готовые ответы
+	idempotencySuffix = ".idempotency"
+	// userIDBlock сколько идентификаторов пользователей резервирует одна запись в журнале учетных записей
+	userIDBlock = 100
+)
+
+// apiKeyRecord запись журнала ключей доступа
+type apiKeyRecord struct {
+	Op string `json:"op"`
+	models.APIKey
+	FromUserID int `json:"from_user_id,omitempty"`
+}
+
+// fileRecord запись журнала. Для create и update заполнен URLData,
+// для delete — UserID и ShortURLs, для purge — ShortURLs, для merge — UserID и FromUserID
+type fileRecord struct {
+	Op string `json:"op,omitempty"`
+	URLData
+	ShortURLs  []string `json:"short_urls,omitempty"`
+	FromUserID int      `json:"from_user_id,omitempty"`
+}
+
+// Producer хранит URL в файле в виде журнала записей, который только дописывается.
+// Журнал периодически сжимается: актуальное состояние пишется во временный файл,
+// который затем атомарно переименовывается поверх журнала.
 type Producer struct {
 	file     *os.File
 	encoder  *json.Encoder
 	filePath string
-	buffer   []URLData
+	mu       sync.Mutex
+	dirty    bool
+
+	clicksFile    *os.File
+	clicksEncoder *json.Encoder
+
+	keysFile    *os.File
+	keysEncoder *json.Encoder
+
+	usersFile    *os.File
+	usersEncoder *json.Encoder
+	// reservedUserID наибольший зарезервированный в журнале идентификатор пользователя
+	reservedUserID int
+
+	idempotencyFile    *os.File
+	idempotencyEncoder *json.Encoder
+
+	syncPolicy      SyncPolicy
+	syncInterval    time.Duration
+	compactInterval time.Duration
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type ProducerOption func(*Producer)
+
+// WithSyncPolicy задает политику fsync, interval используется только для SyncInterval
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) ProducerOption {
+	return func(p *Producer) {
+		p.syncPolicy = policy
+		if interval > 0 {
+			p.syncInterval = interval
+		}
+	}
 }
 
-func NewProducer(filePath string) (*Producer, error) {
+// WithCompactInterval включает фоновое сжатие журнала с заданным интервалом
+func WithCompactInterval(interval time.Duration) ProducerOption {
+	return func(p *Producer) {
+		p.compactInterval = interval
+	}
+}
+
+func NewProducer(filePath string, opts ...ProducerOption) (*Producer, error) {
+	p := &Producer{
+		filePath:     filePath,
+		syncPolicy:   SyncInterval,
+		syncInterval: defaultSyncInterval,
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
 
 	dir := filepath.Dir(filePath)
-	fmt.Printf("dirName %s\n", dir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// остатки прерванного сжатия не нужны, журнал еще не был заменен
+	if err := os.Remove(filePath + compactTmpSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.Remove(filePath + clicksSuffix + compactTmpSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.Remove(filePath + idempotencySuffix + compactTmpSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := truncateBrokenTail(filePath); err != nil {
+		return nil, err
+	}
+	if err := truncateBrokenTail(filePath + clicksSuffix); err != nil {
+		return nil, err
+	}
+	if err := truncateBrokenTail(filePath + apiKeysSuffix); err != nil {
+		return nil, err
+	}
+	if err := truncateBrokenTail(filePath + usersSuffix); err != nil {
+		return nil, err
+	}
+	if err := truncateBrokenTail(filePath + idempotencySuffix); err != nil {
+		return nil, err
+	}
 
-	err := os.MkdirAll("/tmp", 0755)
+	if err := p.openLog(); err != nil {
+		return nil, err
+	}
+	if err := p.openClicks(); err != nil {
+		p.file.Close()
+		return nil, err
+	}
+	keysFile, err := os.OpenFile(filePath+apiKeysSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
+		p.clicksFile.Close()
+		p.file.Close()
 		return nil, err
 	}
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	p.keysFile = keysFile
+	p.keysEncoder = json.NewEncoder(keysFile)
+	usersFile, err := os.OpenFile(filePath+usersSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
-		fmt.Printf("err %s", err)
+		p.keysFile.Close()
+		p.clicksFile.Close()
+		p.file.Close()
+		return nil, err
+	}
+	p.usersFile = usersFile
+	p.usersEncoder = json.NewEncoder(usersFile)
+	if err := p.openIdempotency(); err != nil {
+		p.usersFile.Close()
+		p.keysFile.Close()
+		p.clicksFile.Close()
+		p.file.Close()
 		return nil, err
 	}
 
-	currentDir, err := os.Getwd()
-	fmt.Printf("currDir: %s\n", currentDir)
+	p.wg.Add(1)
+	go p.background()
+
+	return p, nil
+}
+
+func (p *Producer) openLog() error {
+	file, err := os.OpenFile(p.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		logger.Log.Info("Error getting current working directory", zap.Error(err))
+		logger.Log.Error("Error opening file for writing", zap.Error(err))
+		return err
 	}
+	p.file = file
+	p.encoder = json.NewEncoder(file)
+	return nil
+}
 
-	return &Producer{
-		file:     file,
-		encoder:  json.NewEncoder(file),
-		filePath: filePath,
-	}, nil
+func (p *Producer) openClicks() error {
+	file, err := os.OpenFile(p.filePath+clicksSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		logger.Log.Error("Error opening clicks file for writing", zap.Error(err))
+		return err
+	}
+	p.clicksFile = file
+	p.clicksEncoder = json.NewEncoder(file)
+	return nil
+}
+
+func (p *Producer) openIdempotency() error {
+	file, err := os.OpenFile(p.filePath+idempotencySuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Log.Error("Error opening idempotency file for writing", zap.Error(err))
+		return err
+	}
+	p.idempotencyFile = file
+	p.idempotencyEncoder = json.NewEncoder(file)
+	return nil
+}
+
+// truncateBrokenTail обрезает недописанную последнюю запись, оставшуюся после падения процесса
+func truncateBrokenTail(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var validSize int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(line) == 0 {
+			break
+		}
+		if line[len(line)-1] == '\n' && json.Valid(line) {
+			validSize += int64(len(line))
+			continue
+		}
+		// недописанной может быть только последняя запись, порча в середине файла — ошибка
+		if _, err := reader.Peek(1); err == nil {
+			return fmt.Errorf("%w: offset %d", ErrCorruptedFile, validSize)
+		}
+		break
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == validSize {
+		return nil
+	}
+
+	logger.Log.Warn("Truncating broken tail of storage file",
+		zap.String("path", filePath),
+		zap.Int64("size", info.Size()),
+		zap.Int64("valid_size", validSize),
+	)
+	if err := file.Truncate(validSize); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (p *Producer) background() {
+	defer p.wg.Done()
+
+	var syncC, compactC <-chan time.Time
+	if p.syncPolicy == SyncInterval {
+		syncTicker := time.NewTicker(p.syncInterval)
+		defer syncTicker.Stop()
+		syncC = syncTicker.C
+	}
+	if p.compactInterval > 0 {
+		compactTicker := time.NewTicker(p.compactInterval)
+		defer compactTicker.Stop()
+		compactC = compactTicker.C
+	}
+
+	for {
+		select {
+		case <-syncC:
+			if err := p.Sync(); err != nil {
+				logger.Log.Error("Error syncing storage file", zap.Error(err))
+			}
+		case <-compactC:
+			if err := p.Compact(); err != nil {
+				logger.Log.Error("Error compacting storage file", zap.Error(err))
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Producer) appendRecord(record fileRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.appendRecordLocked(record)
+}
+
+// appendRecordLocked вызывается под блокировкой
+func (p *Producer) appendRecordLocked(record fileRecord) error {
+	if err := p.encoder.Encode(record); err != nil {
+		logger.Log.Error("Error encoding data to file", zap.Error(err))
+		return err
+	}
+	if p.syncPolicy == SyncAlways {
+		return p.file.Sync()
+	}
+	p.dirty = true
+	return nil
 }
 
 func (p *Producer) SaveToFileURL(urlData *URLData) error {
-	// Загрузка существующих данных
-	existingData, err := p.LoadInitialData()
+	return p.appendRecord(fileRecord{Op: recordCreate, URLData: *urlData})
+}
+
+// UpdateURL заменяет сохраненную запись с тем же short_url
+func (p *Producer) UpdateURL(urlData *URLData) error {
+	return p.appendRecord(fileRecord{Op: recordUpdate, URLData: *urlData})
+}
+
+// MarkURLAsDeleted проставляет флаг удаления URL пользователя в файле
+func (p *Producer) MarkURLAsDeleted(userID int, shortURLs []string) error {
+	return p.appendRecord(fileRecord{
+		Op:        recordDelete,
+		URLData:   URLData{UserID: userID},
+		ShortURLs: shortURLs,
+	})
+}
+
+// PurgeURLs удаляет ссылки из хранилища через deleteURLs и окончательно удаляет их из файла вместе
+// с переходами, чтобы статистика не досталась следующей ссылке с тем же short_url.
+// Все происходит под блокировкой журнала: новая ссылка с освободившимся short_url попадает в журнал
+// только после записи purge и не удаляется при восстановлении
+func (p *Producer) PurgeURLs(deleteURLs func() ([]string, error)) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	shortURLs, err := deleteURLs()
+	if err != nil || len(shortURLs) == 0 {
+		return shortURLs, err
+	}
+	if err := p.purgeClicks(shortURLs); err != nil {
+		return nil, err
+	}
+	return shortURLs, p.appendRecordLocked(fileRecord{Op: recordPurge, ShortURLs: shortURLs})
+}
+
+// purgeClicks переписывает файл переходов без переходов по shortURLs. Вызывается под блокировкой
+func (p *Producer) purgeClicks(shortURLs []string) error {
+	if err := p.clicksFile.Sync(); err != nil {
+		return err
+	}
+	clicks, err := p.LoadClicks()
+	if err != nil {
+		return err
+	}
+	purged := make(map[string]struct{}, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		purged[shortURL] = struct{}{}
+	}
+	kept := make([]models.Click, 0, len(clicks))
+	for _, click := range clicks {
+		if _, ok := purged[click.ShortURL]; !ok {
+			kept = append(kept, click)
+		}
+	}
+	if len(kept) == len(clicks) {
+		return nil
+	}
+
+	clicksPath := p.filePath + clicksSuffix
+	tmpPath := clicksPath + compactTmpSuffix
+	if err := writeRecords(tmpPath, kept); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, clicksPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(clicksPath))
+
+	// старый дескриптор указывает на замененный файл
+	if err := p.clicksFile.Close(); err != nil {
+		logger.Log.Error("Error closing old clicks file", zap.Error(err))
+	}
+	return p.openClicks()
+}
+
+// SaveClicks дописывает события переходов в файл рядом с журналом
+func (p *Producer) SaveClicks(clicks []models.Click) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, click := range clicks {
+		if err := p.clicksEncoder.Encode(click); err != nil {
+			logger.Log.Error("Error encoding click to file", zap.Error(err))
+			return err
+		}
+	}
+	if p.syncPolicy == SyncAlways {
+		return p.clicksFile.Sync()
+	}
+	p.dirty = true
+	return nil
+}
+
+func (p *Producer) LoadClicks() ([]models.Click, error) {
+	file, err := os.OpenFile(p.filePath+clicksSuffix, os.O_RDONLY|os.O_CREATE, 0666)
 	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	var clicks []models.Click
+	for decoder.More() {
+		var click models.Click
+		if err := decoder.Decode(&click); err != nil {
+			logger.Log.Error("Error decoding click from file", zap.Error(err))
+			return nil, err
+		}
+		clicks = append(clicks, click)
+	}
+	return clicks, nil
+}
+
+// SaveAPIKey дописывает новый ключ доступа в журнал ключей
+func (p *Producer) SaveAPIKey(key models.APIKey) error {
+	return p.appendAPIKeyRecord(apiKeyRecord{Op: recordCreate, APIKey: key})
+}
+
+// RevokeAPIKey дописывает в журнал ключей отзыв ключа
+func (p *Producer) RevokeAPIKey(userID int, id string, revokedAt time.Time) error {
+	return p.appendAPIKeyRecord(apiKeyRecord{
+		Op:     recordRevoke,
+		APIKey: models.APIKey{ID: id, UserID: userID, RevokedAt: revokedAt},
+	})
+}
+
+func (p *Producer) appendAPIKeyRecord(record apiKeyRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.keysEncoder.Encode(record); err != nil {
+		logger.Log.Error("Error encoding api key to file", zap.Error(err))
 		return err
 	}
+	// ключи создаются редко, поэтому всегда сбрасываются на диск сразу
+	return p.keysFile.Sync()
+}
+
+// SaveUser дописывает в журнал учетных записей текущее состояние пользователя
+func (p *Producer) SaveUser(user models.User) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	// Append the new URLData to the existing data
-	existingData = append(existingData, *urlData)
+	if err := p.usersEncoder.Encode(user); err != nil {
+		logger.Log.Error("Error encoding user to file", zap.Error(err))
+		return err
+	}
+	return p.usersFile.Sync()
+}
 
-	// for _, u := range existingData {
-	// 	parts := strings.Split(u.ShortURL, "/")
-	// 	URLId := parts[len(parts)-1]
-	// 	fmt.Printf("shortURL %s; partID %s; origURL %s \n", u.ShortURL, URLId, u.OriginalURL)
-	// }
+// ReserveUserID сохраняет в журнале учетных записей, что идентификатор userID выдан, чтобы после перезапуска
+// он не достался другому анонимному пользователю. Идентификаторы резервируются блоками, поэтому fsync — раз на блок
+func (p *Producer) ReserveUserID(userID int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	// Write the updated data back to the file
-	if err := p.WriteToFile(existingData); err != nil {
-		logger.Log.Error("Error saving URL in file", zap.Error(err))
+	if userID <= p.reservedUserID {
+		return nil
+	}
+	reserved := userID + userIDBlock - 1
+	if err := p.usersEncoder.Encode(models.User{ID: reserved}); err != nil {
+		logger.Log.Error("Error encoding user id reserve to file", zap.Error(err))
 		return err
 	}
+	if err := p.usersFile.Sync(); err != nil {
+		return err
+	}
+	p.reservedUserID = reserved
+	return nil
+}
+
+// SaveIdempotencyRecord дописывает готовый ответ на запрос с Idempotency-Key, чтобы повтор
+// работал и после перезапуска. Запрос, не успевший завершиться до перезапуска, можно выполнить заново
+func (p *Producer) SaveIdempotencyRecord(record models.IdempotencyRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
+	if err := p.idempotencyEncoder.Encode(record); err != nil {
+		logger.Log.Error("Error encoding idempotency record to file", zap.Error(err))
+		return err
+	}
+	if p.syncPolicy == SyncAlways {
+		return p.idempotencyFile.Sync()
+	}
+	p.dirty = true
 	return nil
 }
 
+// LoadIdempotencyRecords возвращает последний ответ по каждому ключу пользователя, не истекший к now
+func (p *Producer) LoadIdempotencyRecords(now time.Time) ([]models.IdempotencyRecord, error) {
+	file, err := os.OpenFile(p.filePath+idempotencySuffix, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	type recordKey struct {
+		userID int
+		key    string
+	}
+	decoder := json.NewDecoder(file)
+	var records []models.IdempotencyRecord
+	index := make(map[recordKey]int)
+	for decoder.More() {
+		var record models.IdempotencyRecord
+		if err := decoder.Decode(&record); err != nil {
+			logger.Log.Error("Error decoding idempotency record from file", zap.Error(err))
+			return nil, err
+		}
+		key := recordKey{userID: record.UserID, key: record.Key}
+		if i, ok := index[key]; ok {
+			records[i] = record
+			continue
+		}
+		index[key] = len(records)
+		records = append(records, record)
+	}
+
+	result := records[:0]
+	for _, record := range records {
+		if record.ExpiresAt.After(now) {
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
+// PurgeExpiredIdempotencyRecords переписывает файл ответов без истекших раньше before
+func (p *Producer) PurgeExpiredIdempotencyRecords(before time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.idempotencyFile.Sync(); err != nil {
+		return err
+	}
+	records, err := p.LoadIdempotencyRecords(before)
+	if err != nil {
+		return err
+	}
+
+	idempotencyPath := p.filePath + idempotencySuffix
+	tmpPath := idempotencyPath + compactTmpSuffix
+	if err := writeRecords(tmpPath, records); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, idempotencyPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(idempotencyPath))
+
+	// старый дескриптор указывает на замененный файл
+	if err := p.idempotencyFile.Close(); err != nil {
+		logger.Log.Error("Error closing old idempotency file", zap.Error(err))
+	}
+	return p.openIdempotency()
+}
+
+// LoadUsers возвращает последнее состояние каждого пользователя из журнала учетных записей
+func (p *Producer) LoadUsers() ([]models.User, error) {
+	file, err := os.OpenFile(p.filePath+usersSuffix, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	var users []models.User
+	index := make(map[int]int)
+	for decoder.More() {
+		var user models.User
+		if err := decoder.Decode(&user); err != nil {
+			logger.Log.Error("Error decoding user from file", zap.Error(err))
+			return nil, err
+		}
+		if i, ok := index[user.ID]; ok {
+			users[i] = user
+			continue
+		}
+		index[user.ID] = len(users)
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// MergeUsers передает в журналах URL и ключей записи пользователя fromUserID пользователю toUserID
+func (p *Producer) MergeUsers(fromUserID, toUserID int) error {
+	err := p.appendRecord(fileRecord{Op: recordMerge, URLData: URLData{UserID: toUserID}, FromUserID: fromUserID})
+	if err != nil {
+		return err
+	}
+	return p.appendAPIKeyRecord(apiKeyRecord{Op: recordMerge, APIKey: models.APIKey{UserID: toUserID}, FromUserID: fromUserID})
+}
+
+// LoadAPIKeys восстанавливает ключи доступа, применяя записи журнала по порядку
+func (p *Producer) LoadAPIKeys() ([]models.APIKey, error) {
+	file, err := os.OpenFile(p.filePath+apiKeysSuffix, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	var order []string
+	keys := make(map[string]models.APIKey)
+	for decoder.More() {
+		var record apiKeyRecord
+		if err := decoder.Decode(&record); err != nil {
+			logger.Log.Error("Error decoding api key from file", zap.Error(err))
+			return nil, err
+		}
+		switch record.Op {
+		case recordCreate:
+			if _, ok := keys[record.ID]; !ok {
+				order = append(order, record.ID)
+			}
+			keys[record.ID] = record.APIKey
+		case recordRevoke:
+			if key, ok := keys[record.ID]; ok && key.UserID == record.UserID {
+				key.RevokedAt = record.RevokedAt
+				keys[record.ID] = key
+			}
+		case recordMerge:
+			for id, key := range keys {
+				if key.UserID == record.FromUserID {
+					key.UserID = record.UserID
+					keys[id] = key
+				}
+			}
+		}
+	}
+
+	result := make([]models.APIKey, 0, len(order))
+	for _, id := range order {
+		result = append(result, keys[id])
+	}
+	return result, nil
+}
+
+// LoadInitialData восстанавливает текущее состояние, последовательно применяя записи журнала
 func (p *Producer) LoadInitialData() ([]URLData, error) {
-	fmt.Printf("p.filePath loadFromFile %s: \n", p.filePath)
 	file, err := os.OpenFile(p.filePath, os.O_RDONLY|os.O_CREATE, 0666)
 	if err != nil {
 		logger.Log.Error("Error opening file for reading", zap.Error(err))
@@ -81,39 +705,208 @@ func (p *Producer) LoadInitialData() ([]URLData, error) {
 
 	decoder := json.NewDecoder(file)
 	var urlDataSlice []URLData
+	index := make(map[string]int)
+	purged := make(map[int]struct{})
 	for decoder.More() {
-		var urlData URLData
-		err := decoder.Decode(&urlData)
+		var record fileRecord
+		err := decoder.Decode(&record)
 		if err != nil {
 			logger.Log.Error("Error decoding data from file", zap.Error(err))
 			return nil, err
 		}
-		urlDataSlice = append(urlDataSlice, urlData)
+
+		switch record.Op {
+		case recordDelete:
+			for _, shortURL := range record.ShortURLs {
+				i, ok := index[shortURL]
+				if ok && urlDataSlice[i].UserID == record.UserID {
+					urlDataSlice[i].DeletedFlag = true
+				}
+			}
+		case recordMerge:
+			for i := range urlDataSlice {
+				if urlDataSlice[i].UserID == record.FromUserID {
+					urlDataSlice[i].UserID = record.UserID
+				}
+			}
+		case recordPurge:
+			for _, shortURL := range record.ShortURLs {
+				if i, ok := index[shortURL]; ok {
+					purged[i] = struct{}{}
+					delete(index, shortURL)
+				}
+			}
+		default:
+			// в старых файлах short_url хранился вместе с BaseURL
+			shortURL := path.Base(record.ShortURL)
+			record.ShortURL = shortURL
+			// повторный create заменяет запись: short_url мог освободиться и достаться новой ссылке
+			if i, ok := index[shortURL]; ok {
+				urlDataSlice[i] = record.URLData
+				continue
+			}
+			index[shortURL] = len(urlDataSlice)
+			urlDataSlice = append(urlDataSlice, record.URLData)
+		}
 	}
 
-	return urlDataSlice, nil
+	if len(purged) == 0 {
+		return urlDataSlice, nil
+	}
+	result := make([]URLData, 0, len(urlDataSlice)-len(purged))
+	for i, data := range urlDataSlice {
+		if _, ok := purged[i]; !ok {
+			result = append(result, data)
+		}
+	}
+	return result, nil
 }
 
-func (p *Producer) WriteToFile(urlData []URLData) error {
-	file, err := os.OpenFile(p.filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+// Compact заменяет журнал снимком текущего состояния
+func (p *Producer) Compact() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+
+	urlDataSlice, err := p.LoadInitialData()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := p.filePath + compactTmpSuffix
+	if err := writeSnapshot(tmpPath, urlDataSlice); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, p.filePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(p.filePath))
+
+	// старый дескриптор указывает на замененный файл
+	if err := p.file.Close(); err != nil {
+		logger.Log.Error("Error closing old storage file", zap.Error(err))
+	}
+	return p.openLog()
+}
+
+func writeSnapshot(filePath string, urlData []URLData) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		logger.Log.Error("Error opening file for writing", zap.Error(err))
 		return err
 	}
 	defer file.Close()
 
-	encoder := json.NewEncoder(file)
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
 	for _, data := range urlData {
-		if err := encoder.Encode(data); err != nil {
-			logger.Log.Error("Error encoding data to file", zap.Error(err))
+		if err := encoder.Encode(fileRecord{Op: recordCreate, URLData: data}); err != nil {
 			return err
 		}
 	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
 
-	return nil
+// writeRecords записывает файл из JSON-записей, по одной на строку
+func writeRecords[T any](filePath string, records []T) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// syncDir сбрасывает на диск запись каталога после переименования файла
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
+
+func (p *Producer) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.dirty {
+		return nil
+	}
+	p.dirty = false
+	if err := p.clicksFile.Sync(); err != nil {
+		return err
+	}
+	if err := p.idempotencyFile.Sync(); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+// CheckWritable проверяет, что файл журнала на месте и открывается на запись. Содержимое не меняется
+func (p *Producer) CheckWritable() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	file, err := os.OpenFile(p.filePath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
 }
 
 func (p *Producer) Close() error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+		close(p.done)
+	}
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.file.Sync(); err != nil {
+		logger.Log.Error("Error syncing storage file", zap.Error(err))
+	}
+	if err := p.clicksFile.Sync(); err != nil {
+		logger.Log.Error("Error syncing clicks file", zap.Error(err))
+	}
+	if err := p.clicksFile.Close(); err != nil {
+		logger.Log.Error("Error closing clicks file", zap.Error(err))
+	}
+	if err := p.keysFile.Close(); err != nil {
+		logger.Log.Error("Error closing api keys file", zap.Error(err))
+	}
+	if err := p.usersFile.Close(); err != nil {
+		logger.Log.Error("Error closing users file", zap.Error(err))
+	}
+	if err := p.idempotencyFile.Sync(); err != nil {
+		logger.Log.Error("Error syncing idempotency file", zap.Error(err))
+	}
+	if err := p.idempotencyFile.Close(); err != nil {
+		logger.Log.Error("Error closing idempotency file", zap.Error(err))
+	}
 	if err := p.file.Close(); err != nil {
 		return fmt.Errorf("error closing file: %w", err)
 	}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducer_LoadInitialData(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+
+	p, err := NewProducer(filePath, WithSyncPolicy(SyncAlways, 0))
+	require.NoError(t, err)
+
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 1, ShortURL: "aaa", OriginalURL: "https://ya.ru/", UserID: 1}))
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 2, ShortURL: "bbb", OriginalURL: "https://mail.ru/", UserID: 2}))
+	require.NoError(t, p.UpdateURL(&URLData{UUID: 2, ShortURL: "bbb", OriginalURL: "https://go.dev/", UserID: 2}))
+	// чужой URL не удаляется
+	require.NoError(t, p.MarkURLAsDeleted(2, []string{"aaa", "bbb"}))
+	require.NoError(t, p.Close())
+
+	p, err = NewProducer(filePath)
+	require.NoError(t, err)
+	defer p.Close()
+
+	data, err := p.LoadInitialData()
+	require.NoError(t, err)
+	assert.Equal(t, []URLData{
+		{UUID: 1, ShortURL: "aaa", OriginalURL: "https://ya.ru/", UserID: 1},
+		{UUID: 2, ShortURL: "bbb", OriginalURL: "https://go.dev/", UserID: 2, DeletedFlag: true},
+	}, data)
+}
+
+func TestProducer_TruncateBrokenTail(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+	content := `{"uuid":1,"short_url":"aaa","original_url":"https://ya.ru/"}` + "\n" +
+		`{"op":"create","uuid":2,"short_url":"bb`
+	require.NoError(t, os.WriteFile(filePath, []byte(content), 0666))
+
+	p, err := NewProducer(filePath)
+	require.NoError(t, err)
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 3, ShortURL: "ccc", OriginalURL: "https://mail.ru/"}))
+
+	data, err := p.LoadInitialData()
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	assert.Equal(t, []URLData{
+		{UUID: 1, ShortURL: "aaa", OriginalURL: "https://ya.ru/"},
+		{UUID: 3, ShortURL: "ccc", OriginalURL: "https://mail.ru/"},
+	}, data)
+}
+
+func TestProducer_CorruptedMiddle(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+	content := `{"uuid":1,"short_url":"aaa"` + "\n" +
+		`{"uuid":2,"short_url":"bbb","original_url":"https://ya.ru/"}` + "\n"
+	require.NoError(t, os.WriteFile(filePath, []byte(content), 0666))
+
+	_, err := NewProducer(filePath)
+	assert.ErrorIs(t, err, ErrCorruptedFile)
+}
+
+func TestProducer_Compact(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+
+	p, err := NewProducer(filePath)
+	require.NoError(t, err)
+	defer p.Close()
+
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 1, ShortURL: "aaa", OriginalURL: "https://ya.ru/", UserID: 1}))
+	require.NoError(t, p.MarkURLAsDeleted(1, []string{"aaa"}))
+	before, err := p.LoadInitialData()
+	require.NoError(t, err)
+
+	require.NoError(t, p.Compact())
+	// после сжатия журнал продолжает дописываться
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 2, ShortURL: "bbb", OriginalURL: "https://mail.ru/", UserID: 1}))
+
+	after, err := p.LoadInitialData()
+	require.NoError(t, err)
+	assert.Equal(t, append(before, URLData{UUID: 2, ShortURL: "bbb", OriginalURL: "https://mail.ru/", UserID: 1}), after)
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), `"op":"delete"`)
+	_, err = os.Stat(filePath + compactTmpSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestProducer_PurgeURLs(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+	clickedAt := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	p, err := NewProducer(filePath, WithSyncPolicy(SyncAlways, 0))
+	require.NoError(t, err)
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 1, ShortURL: "aaa", OriginalURL: "https://ya.ru/", UserID: 1}))
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 2, ShortURL: "bbb", OriginalURL: "https://mail.ru/", UserID: 1}))
+	require.NoError(t, p.SaveClicks([]models.Click{
+		{ShortURL: "aaa", ClickedAt: clickedAt, Referrer: "https://go.dev/", IP: "192.168.1.0"},
+		{ShortURL: "bbb", ClickedAt: clickedAt},
+	}))
+	purged, err := p.PurgeURLs(func() ([]string, error) { return []string{"aaa"}, nil })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aaa"}, purged)
+	// после перезаписи файл переходов продолжает дописываться
+	require.NoError(t, p.SaveClicks([]models.Click{{ShortURL: "bbb", ClickedAt: clickedAt.Add(time.Hour)}}))
+	require.NoError(t, p.Close())
+
+	p, err = NewProducer(filePath)
+	require.NoError(t, err)
+	defer p.Close()
+
+	data, err := p.LoadInitialData()
+	require.NoError(t, err)
+	assert.Equal(t, []URLData{{UUID: 2, ShortURL: "bbb", OriginalURL: "https://mail.ru/", UserID: 1}}, data)
+
+	clicks, err := p.LoadClicks()
+	require.NoError(t, err)
+	assert.Equal(t, []models.Click{
+		{ShortURL: "bbb", ClickedAt: clickedAt},
+		{ShortURL: "bbb", ClickedAt: clickedAt.Add(time.Hour)},
+	}, clicks)
+	_, err = os.Stat(filePath + clicksSuffix + compactTmpSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestProducer_PurgeAndReuseAlias(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+
+	p, err := NewProducer(filePath)
+	require.NoError(t, err)
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 1, ShortURL: "alias", OriginalURL: "https://ya.ru/", UserID: 1}))
+	_, err = p.PurgeURLs(func() ([]string, error) { return []string{"alias"}, nil })
+	require.NoError(t, err)
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 2, ShortURL: "alias", OriginalURL: "https://mail.ru/", UserID: 2}))
+	// create без purge между ними, как при записи purge после новой ссылки, тоже заменяет запись
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 3, ShortURL: "other", OriginalURL: "https://go.dev/", UserID: 1}))
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 4, ShortURL: "other", OriginalURL: "https://go.dev/doc/", UserID: 2}))
+	require.NoError(t, p.Close())
+
+	p, err = NewProducer(filePath)
+	require.NoError(t, err)
+	defer p.Close()
+
+	data, err := p.LoadInitialData()
+	require.NoError(t, err)
+	assert.Equal(t, []URLData{
+		{UUID: 2, ShortURL: "alias", OriginalURL: "https://mail.ru/", UserID: 2},
+		{UUID: 4, ShortURL: "other", OriginalURL: "https://go.dev/doc/", UserID: 2},
+	}, data)
+}
+
+func TestProducer_LoadAPIKeys(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+	createdAt := time.Date(2023, 11, 10, 0, 0, 0, 0, time.UTC)
+	revokedAt := createdAt.Add(time.Hour)
+
+	p, err := NewProducer(filePath)
+	require.NoError(t, err)
+	require.NoError(t, p.SaveAPIKey(models.APIKey{ID: "k1", UserID: 1, KeyHash: "h1", CreatedAt: createdAt}))
+	require.NoError(t, p.SaveAPIKey(models.APIKey{ID: "k2", UserID: 1, KeyHash: "h2", Scopes: []string{ScopeRead}, CreatedAt: createdAt}))
+	// чужой ключ не отзывается
+	require.NoError(t, p.RevokeAPIKey(2, "k2", revokedAt))
+	require.NoError(t, p.RevokeAPIKey(1, "k1", revokedAt))
+	require.NoError(t, p.Close())
+
+	p, err = NewProducer(filePath)
+	require.NoError(t, err)
+	defer p.Close()
+
+	keys, err := p.LoadAPIKeys()
+	require.NoError(t, err)
+	assert.Equal(t, []models.APIKey{
+		{ID: "k1", UserID: 1, KeyHash: "h1", CreatedAt: createdAt, RevokedAt: revokedAt},
+		{ID: "k2", UserID: 1, KeyHash: "h2", Scopes: []string{ScopeRead}, CreatedAt: createdAt},
+	}, keys)
+}
+
+func TestProducer_MergeUsers(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+
+	p, err := NewProducer(filePath)
+	require.NoError(t, err)
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 1, ShortURL: "aaa", OriginalURL: "https://ya.ru/", UserID: 1}))
+	require.NoError(t, p.SaveToFileURL(&URLData{UUID: 2, ShortURL: "bbb", OriginalURL: "https://mail.ru/", UserID: 2}))
+	require.NoError(t, p.SaveAPIKey(models.APIKey{ID: "k1", UserID: 2, KeyHash: "h1"}))
+	require.NoError(t, p.SaveUser(models.User{ID: 1, Email: "user@example.com", PasswordHash: "old"}))
+	require.NoError(t, p.SaveUser(models.User{ID: 1, Email: "user@example.com", PasswordHash: "new"}))
+	require.NoError(t, p.MergeUsers(2, 1))
+	require.NoError(t, p.Compact())
+	require.NoError(t, p.Close())
+
+	p, err = NewProducer(filePath)
+	require.NoError(t, err)
+	defer p.Close()
+
+	data, err := p.LoadInitialData()
+	require.NoError(t, err)
+	assert.Equal(t, []URLData{
+		{UUID: 1, ShortURL: "aaa", OriginalURL: "https://ya.ru/", UserID: 1},
+		{UUID: 2, ShortURL: "bbb", OriginalURL: "https://mail.ru/", UserID: 1},
+	}, data)
+
+	keys, err := p.LoadAPIKeys()
+	require.NoError(t, err)
+	assert.Equal(t, 1, keys[0].UserID)
+
+	users, err := p.LoadUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []models.User{{ID: 1, Email: "user@example.com", PasswordHash: "new"}}, users)
+}
+
+func TestProducer_ReserveUserID(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+
+	p, err := NewProducer(filePath)
+	require.NoError(t, err)
+	require.NoError(t, p.ReserveUserID(1))
+	// идентификатор из уже зарезервированного блока не пишется в журнал
+	require.NoError(t, p.ReserveUserID(2))
+	require.NoError(t, p.ReserveUserID(userIDBlock+1))
+	registeredAt := time.Date(2023, 11, 20, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, p.SaveUser(models.User{ID: 2, Email: "user@example.com", PasswordHash: "hash", RegisteredAt: &registeredAt}))
+	require.NoError(t, p.Close())
+
+	// у записей резерва времени регистрации нет
+	data, err := os.ReadFile(filePath + usersSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "registered_at"))
+
+	p, err = NewProducer(filePath)
+	require.NoError(t, err)
+	defer p.Close()
+
+	users, err := p.LoadUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []models.User{
+		{ID: userIDBlock},
+		{ID: 2 * userIDBlock},
+		{ID: 2, Email: "user@example.com", PasswordHash: "hash", RegisteredAt: &registeredAt},
+	}, users)
+}
+
+func TestProducer_IdempotencyRecords(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "short-url-db.json")
+	now := time.Date(2023, 11, 20, 12, 0, 0, 0, time.UTC)
+	record := func(userID int, key string, status int, expiresAt time.Time) models.IdempotencyRecord {
+		return models.IdempotencyRecord{UserID: userID, Key: key, RequestHash: "hash", StatusCode: status,
+			ContentType: "application/json", Body: []byte(`{"result":"x"}`), CreatedAt: now, ExpiresAt: expiresAt}
+	}
+
+	p, err := NewProducer(filePath)
+	require.NoError(t, err)
+	require.NoError(t, p.SaveIdempotencyRecord(record(1, "a", 201, now.Add(time.Hour))))
+	require.NoError(t, p.SaveIdempotencyRecord(record(1, "expired", 201, now.Add(-time.Minute))))
+	// ключ другого пользователя не заменяет ответ первого, повторная запись того же ключа — заменяет
+	require.NoError(t, p.SaveIdempotencyRecord(record(2, "a", 409, now.Add(time.Hour))))
+	require.NoError(t, p.SaveIdempotencyRecord(record(1, "a", 409, now.Add(2*time.Hour))))
+	require.NoError(t, p.Close())
+
+	p, err = NewProducer(filePath)
+	require.NoError(t, err)
+	defer p.Close()
+
+	records, err := p.LoadIdempotencyRecords(now)
+	require.NoError(t, err)
+	assert.Equal(t, []models.IdempotencyRecord{
+		record(1, "a", 409, now.Add(2*time.Hour)),
+		record(2, "a", 409, now.Add(time.Hour)),
+	}, records)
+
+	require.NoError(t, p.PurgeExpiredIdempotencyRecords(now.Add(90*time.Minute)))
+	// после перезаписи файл продолжает дописываться
+	require.NoError(t, p.SaveIdempotencyRecord(record(3, "b", 201, now.Add(3*time.Hour))))
+	records, err = p.LoadIdempotencyRecords(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []models.IdempotencyRecord{
+		record(1, "a", 409, now.Add(2*time.Hour)),
+		record(3, "b", 201, now.Add(3*time.Hour)),
+	}, records)
+}
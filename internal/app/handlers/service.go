@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/metrics"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/Tokebay/yandex/internal/screening"
+	"github.com/Tokebay/yandex/internal/urlnorm"
+	"go.uber.org/zap"
+)
+
+// Операции сервиса, общие для HTTP и gRPC. Транспорт только разбирает запрос и переводит ошибки в свои коды
+
+var ErrURLGone = errors.New("url is deleted or expired")
+
+// коды ошибок проверки элементов пачки
+const (
+	ValidationErrorURL          = "invalid_url"
+	ValidationErrorAlias        = "invalid_alias"
+	ValidationErrorReserved     = "reserved_alias"
+	ValidationErrorExpiration   = "invalid_expiration"
+	ValidationErrorBatch        = "invalid_batch"
+	ValidationErrorBlocked      = "blocked_url"
+	ValidationErrorBlockedBatch = "blocked_batch"
+)
+
+// BatchValidationError ошибки проверки всех неверных элементов пачки
+type BatchValidationError struct {
+	Items []models.BatchItemError
+}
+
+func (e *BatchValidationError) Error() string {
+	return batchItemsMessage(e.Items)
+}
+
+// BatchBlockedError элементы пачки с заблокированными адресами назначения
+type BatchBlockedError struct {
+	Items []models.BatchItemError
+}
+
+func (e *BatchBlockedError) Error() string {
+	return batchItemsMessage(e.Items)
+}
+
+func (e *BatchBlockedError) Unwrap() error {
+	return screening.ErrBlocked
+}
+
+func batchItemsMessage(items []models.BatchItemError) string {
+	messages := make([]string, 0, len(items))
+	for _, item := range items {
+		messages = append(messages, fmt.Sprintf("correlation_id %s: %s", item.CorrelationID, item.Message))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// IsValidationError ошибка в параметрах запроса пользователя
+func IsValidationError(err error) bool {
+	var batchErr *BatchValidationError
+	return errors.Is(err, ErrAliasInvalid) || errors.Is(err, ErrAliasReserved) || errors.Is(err, ErrExpirationInvalid) ||
+		errors.Is(err, urlnorm.ErrInvalidURL) || errors.As(err, &batchErr)
+}
+
+// validationCode машиночитаемый код ошибки проверки
+func validationCode(err error) string {
+	switch {
+	case errors.Is(err, urlnorm.ErrInvalidURL):
+		return ValidationErrorURL
+	case errors.Is(err, ErrAliasReserved):
+		return ValidationErrorReserved
+	case errors.Is(err, ErrAliasInvalid):
+		return ValidationErrorAlias
+	}
+	return ValidationErrorExpiration
+}
+
+// normalizeURL проверяет и нормализует сокращаемый URL по настройкам сервиса
+func (us *URLShortener) normalizeURL(rawURL string) (string, error) {
+	return urlnorm.Normalize(rawURL, urlnorm.Options{
+		MaxLength:     us.config.MaxURLLength,
+		StripFragment: us.config.StripURLFragment,
+	})
+}
+
+// SetScreener включает проверку адресов назначения при сокращении и переходе по ссылке
+func (us *URLShortener) SetScreener(screener *screening.Screener) {
+	us.screener = screener
+}
+
+// screenURL проверяет адрес назначения перед сохранением ссылки
+func (us *URLShortener) screenURL(ctx context.Context, userID int, originalURL string) error {
+	if us.screener == nil {
+		return nil
+	}
+	err := us.screener.Check(ctx, originalURL)
+	if errors.Is(err, screening.ErrBlocked) {
+		metrics.ObserveBlocked(metrics.StageShorten)
+		logger.FromContext(ctx).Warn("Blocked destination",
+			zap.Int("user_id", userID), zap.String("original_url", originalURL), zap.Error(err))
+	}
+	return err
+}
+
+// validateShortenRequest проверяет URL, алиас и срок жизни ссылки. Возвращает нормализованный URL и момент истечения
+func (us *URLShortener) validateShortenRequest(rawURL, alias string, expiresAt *time.Time, ttlSeconds int64, now time.Time) (string, time.Time, error) {
+	originalURL, err := us.normalizeURL(rawURL)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if alias != "" {
+		if err := ValidateAlias(alias); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	expires, err := expirationTime(expiresAt, ttlSeconds, now)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return originalURL, expires, nil
+}
+
+// ShortenURL проверяет и сохраняет ссылку пользователя. Возвращает полный короткий URL;
+// created ложно, если этот URL уже был сокращен и возвращена прежняя ссылка
+func (us *URLShortener) ShortenURL(ctx context.Context, userID int, req models.Request) (string, bool, error) {
+	originalURL, expiresAt, err := us.validateShortenRequest(req.URL, req.CustomAlias, req.ExpiresAt, req.TTLSeconds, time.Now())
+	if err != nil {
+		return "", false, err
+	}
+	if err := us.screenURL(ctx, userID, originalURL); err != nil {
+		return "", false, err
+	}
+
+	// Без пользовательского идентификатора будет сгенерирован случайный
+	mURL := models.ShortenURL{
+		ShortURL:    req.CustomAlias,
+		OriginalURL: originalURL,
+		UserID:      userID,
+		ExpiresAt:   expiresAt,
+	}
+	id, httpStatusCode, err := us.saveShortenURL(ctx, mURL)
+	if err != nil {
+		return "", false, err
+	}
+	return us.buildShortURL(id), httpStatusCode == http.StatusCreated, nil
+}
+
+// ShortenBatch сохраняет пачку ссылок пользователя. created ложно, если хотя бы один URL уже был сокращен.
+// Если неверны какие-то элементы, ничего не сохраняется и возвращается *BatchValidationError со всеми ошибками,
+// если заблокированы адреса назначения — *BatchBlockedError
+func (us *URLShortener) ShortenBatch(ctx context.Context, userID int, req models.BatchShortenRequest) (models.BatchShortenResponse, bool, error) {
+	now := time.Now()
+	mURLs := make([]models.ShortenURL, 0, len(req))
+	var invalid []models.BatchItemError
+	for _, url := range req {
+		originalURL, expiresAt, err := us.validateShortenRequest(url.OriginalURL, url.CustomAlias, url.ExpiresAt, url.TTLSeconds, now)
+		if err != nil {
+			invalid = append(invalid, models.BatchItemError{
+				CorrelationID: url.CorrelationID,
+				Code:          validationCode(err),
+				Message:       err.Error(),
+			})
+			continue
+		}
+
+		shortURL := url.CustomAlias
+		if shortURL == "" {
+			shortURL = us.GenerateID()
+		}
+		mURLs = append(mURLs, models.ShortenURL{
+			ShortURL:    shortURL,
+			OriginalURL: originalURL,
+			UserID:      userID,
+			ExpiresAt:   expiresAt,
+		})
+	}
+	if len(invalid) > 0 {
+		return nil, false, &BatchValidationError{Items: invalid}
+	}
+	var blocked []models.BatchItemError
+	for i, url := range mURLs {
+		err := us.screenURL(ctx, userID, url.OriginalURL)
+		if errors.Is(err, screening.ErrBlocked) {
+			blocked = append(blocked, models.BatchItemError{
+				CorrelationID: req[i].CorrelationID,
+				Code:          ValidationErrorBlocked,
+				Message:       err.Error(),
+			})
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if len(blocked) > 0 {
+		return nil, false, &BatchBlockedError{Items: blocked}
+	}
+
+	created := true
+	shortURLs, err := us.Storage.SaveBatchURL(ctx, mURLs)
+	if errors.Is(err, storage.ErrAlreadyExistURL) {
+		created = false
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	resp := make(models.BatchShortenResponse, 0, len(req))
+	for i, url := range req {
+		// новые URL дописываем в файл
+		if us.fileStorage != nil && shortURLs[i] == mURLs[i].ShortURL {
+			urlData := &URLData{
+				UUID:        us.GenerateUUID(),
+				ShortURL:    mURLs[i].ShortURL,
+				OriginalURL: mURLs[i].OriginalURL,
+				UserID:      mURLs[i].UserID,
+				ExpiresAt:   timePtr(mURLs[i].ExpiresAt),
+			}
+			if err := us.SaveToFile(ctx, urlData); err != nil {
+				return nil, false, err
+			}
+		}
+
+		resp = append(resp, models.BatchShortenResponseItem{
+			CorrelationID: url.CorrelationID,
+			ShortURL:      us.buildShortURL(shortURLs[i]),
+		})
+	}
+	return resp, created, nil
+}
+
+// ResolveURL возвращает ссылку по идентификатору. Для удаленной, истекшей или ведущей не на http(s) ссылки
+// возвращает ее вместе с ErrURLGone, для заблокированной — с screening.ErrBlocked, для неизвестной — storage.ErrURLNotFound
+func (us *URLShortener) ResolveURL(ctx context.Context, id string) (models.ShortenURL, error) {
+	url, err := us.Storage.GetURL(ctx, id)
+	if err != nil {
+		return models.ShortenURL{}, err
+	}
+	if url.DeletedFlag || url.IsExpired(time.Now()) {
+		return url, ErrURLGone
+	}
+	// ссылки, сохраненные до проверки URL, могут вести на javascript: и подобные схемы
+	if !urlnorm.IsHTTP(url.OriginalURL) {
+		return url, ErrURLGone
+	}
+	// домен могли заблокировать после сокращения. Внешний сервис на каждый переход не вызываем
+	if us.screener != nil {
+		if err := us.screener.CheckLocal(url.OriginalURL); err != nil {
+			metrics.ObserveBlocked(metrics.StageRedirect)
+			return url, err
+		}
+	}
+	return url, nil
+}
+
+// UserURLs возвращает ссылки пользователя с полными короткими URL
+func (us *URLShortener) UserURLs(ctx context.Context, userID int) ([]models.UserURL, error) {
+	userURLs, err := us.Storage.GetUserURLs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make([]models.UserURL, 0, len(userURLs))
+	for _, url := range userURLs {
+		urls = append(urls, models.UserURL{
+			ShortURL:    us.buildShortURL(url.ShortURL),
+			OriginalURL: url.OriginalURL,
+			ExpiresAt:   timePtr(url.ExpiresAt),
+		})
+	}
+	return urls, nil
+}
+
+// DeleteUserURLs ставит ссылки пользователя в очередь на удаление
+func (us *URLShortener) DeleteUserURLs(ctx context.Context, userID int, shortURLs []string) error {
+	return us.enqueueDeletion(ctx, userID, shortURLs)
+}
+
+// Ping проверяет соединение с хранилищем
+func (us *URLShortener) Ping(ctx context.Context) error {
+	return us.Storage.Ping(ctx)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"go.uber.org/zap"
+)
+
+// коды ошибок 401 в JSON-ответе
+const (
+	AuthErrorMissing = "token_missing"
+	AuthErrorInvalid = "token_invalid"
+	AuthErrorExpired = "token_expired"
+	// AuthErrorScope ключ доступа не разрешает операцию, ответ 403
+	AuthErrorScope = "insufficient_scope"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// resolveIdentity возвращает пользователя из заголовка Authorization или cookie. Сессия в cookie при необходимости
+// продлевается: токен старше половины срока жизни перевыпускается, истекший недавно — выдается заново тому же пользователю.
+// scope — операция, которую должен разрешать ключ доступа. Без учетных данных возвращает пустую Identity.
+// При ошибке ответ уже записан
+func (us *URLShortener) resolveIdentity(w http.ResponseWriter, r *http.Request, scope string) (Identity, error) {
+	if authorization := r.Header.Get(authorizationHeader); authorization != "" {
+		return us.bearerIdentity(w, r, authorization, scope)
+	}
+
+	userID, err := us.sessionUserID(w, r)
+	return Identity{UserID: userID}, err
+}
+
+func (us *URLShortener) sessionUserID(w http.ResponseWriter, r *http.Request) (int, error) {
+	cookie, err := r.Cookie(CookieName)
+	if errors.Is(err, http.ErrNoCookie) {
+		return 0, nil
+	}
+	if err != nil {
+		writeAuthError(w, AuthErrorInvalid, "invalid token cookie")
+		return 0, err
+	}
+
+	now := time.Now()
+	claims, err := ParseToken(cookie.Value)
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		if !us.withinGracePeriod(claims, now) {
+			writeAuthError(w, AuthErrorExpired, "token expired, sign in again")
+			return 0, err
+		}
+	case err != nil:
+		writeAuthError(w, AuthErrorInvalid, "invalid token")
+		return 0, err
+	case !us.needsRenewal(claims, now):
+		return claims.UserID, nil
+	}
+
+	if err := us.setSessionCookie(w, r, claims.UserID); err != nil {
+		return 0, err
+	}
+	return claims.UserID, nil
+}
+
+// withinGracePeriod истина, когда истекший токен еще можно перевыпустить тому же пользователю
+func (us *URLShortener) withinGracePeriod(claims *Claims, now time.Time) bool {
+	return claims.ExpiresAt != nil && now.Sub(claims.ExpiresAt.Time) <= us.config.SessionGracePeriod
+}
+
+// needsRenewal истина, когда до истечения токена осталось меньше половины срока жизни сессии
+func (us *URLShortener) needsRenewal(claims *Claims, now time.Time) bool {
+	if claims.ExpiresAt == nil {
+		return true
+	}
+	return claims.ExpiresAt.Time.Sub(now) < us.sessionLifetime()/2
+}
+
+func (us *URLShortener) sessionLifetime() time.Duration {
+	if us.config.SessionLifetime > 0 {
+		return us.config.SessionLifetime
+	}
+	return TokenExp
+}
+
+// setSessionCookie выдает пользователю новый токен. При ошибке ответ 500 уже записан
+func (us *URLShortener) setSessionCookie(w http.ResponseWriter, r *http.Request, userID int) error {
+	token, err := BuildSessionToken(userID, us.sessionLifetime())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		logger.FromContext(r.Context()).Error("setSessionCookie. error BuildSessionToken", zap.Error(err))
+		return err
+	}
+	setTokenCookie(w, token, us.config.EnableHTTPS)
+	return nil
+}
+
+func writeAuthError(w http.ResponseWriter, code, message string) {
+	writeJSONError(w, http.StatusUnauthorized, code, message)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.ErrorResponse{Code: code, Message: message})
+}
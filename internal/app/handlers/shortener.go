@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Tokebay/yandex/config"
 	"github.com/google/uuid"
@@ -14,6 +18,8 @@ import (
 	"github.com/Tokebay/yandex/internal/app/storage"
 	"github.com/Tokebay/yandex/internal/logger"
 	"github.com/Tokebay/yandex/internal/models"
+	"github.com/Tokebay/yandex/internal/screening"
+	"github.com/Tokebay/yandex/internal/tracing"
 	"go.uber.org/zap"
 )
 
@@ -24,17 +30,23 @@ type URLShortener struct {
 	fileStorage    *Producer
 	uuidCounter    int // счетчик UUID
 	uuidMu         sync.Mutex
-	URLDataSlice   []URLData
-	deleteCh       chan struct {
-		UserID int
-		URL    string
-	}
+	deleteCh       chan deleteRequest
+	deleteWorkers  deleteWorkers
+	clickRecorder  *ClickRecorder
+	trustedSubnet  *net.IPNet
+	screener       *screening.Screener
+
+	readinessChecks []readinessCheck
 }
 
 type URLData struct {
 	UUID        int    `json:"uuid"`
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
+	UserID      int    `json:"user_id,omitempty"`
+	DeletedFlag bool   `json:"is_deleted,omitempty"`
+
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 func (us *URLShortener) CloseFileStorage() error {
@@ -58,10 +70,7 @@ const buffSize = 100
 
 func NewURLShortener(cfg *config.Config, storage storage.URLStorage, fileStorage *Producer) *URLShortener {
 
-	deleteCh := make(chan struct {
-		UserID int
-		URL    string
-	}, buffSize)
+	deleteCh := make(chan deleteRequest, buffSize)
 
 	us := &URLShortener{
 		config:      cfg,
@@ -69,32 +78,22 @@ func NewURLShortener(cfg *config.Config, storage storage.URLStorage, fileStorage
 		fileStorage: fileStorage,
 		uuidCounter: 0,
 		deleteCh:    deleteCh,
+
+		trustedSubnet: parseTrustedSubnet(cfg.TrustedSubnet),
 	}
+	us.clickRecorder = NewClickRecorder(us.saveClicks)
+	us.defaultReadinessChecks()
+	us.startDeleteWorkers(cfg.DeleteWorkers, cfg.DeleteBatchSize, cfg.DeleteFlushInterval)
 
 	return us
 }
 
-func (us *URLShortener) ProcessDeletedURLs() error {
-	fmt.Println("ProcessDeletedURLs")
-	for deleteRequest := range us.deleteCh {
-		// Получил данные из канала для проставления флага удаления
-		pgStorage := us.Storage.(*storage.PostgreSQLStorage)
-		err := pgStorage.MarkURLAsDeleted(deleteRequest.UserID, deleteRequest.URL)
-		if err != nil {
-			logger.Log.Error("Error marking URL as deleted", zap.Error(err))
-			return err
-		}
-	}
-	return nil
-}
-
 func (us *URLShortener) ShortenURLHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	cfg := us.config
 	url, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 
@@ -103,121 +102,162 @@ func (us *URLShortener) ShortenURLHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Генерируем случайный идентификатор для сокращения URL
-	id := us.GenerateID()
-	shortenedURL := cfg.BaseURL + "/" + id
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
 
-	fmt.Printf("DSN %s; fileStorage %s \n", cfg.DSN, cfg.FileStoragePath)
-	httpStatusCode := http.StatusCreated
+	req := models.Request{
+		URL:         string(url),
+		CustomAlias: r.URL.Query().Get(aliasParam),
+	}
+	logger.FromContext(r.Context()).Debug("Received URL to save",
+		zap.Int("user_id", userID), zap.String("original_url", req.URL), zap.String("custom_alias", req.CustomAlias))
 
-	if cfg.DSN != "" {
-		userID, err := us.GetNextUserID(w, r)
-		fmt.Printf("shortener. user %d; err %s \n", userID, err)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	shortenedURL, created, err := us.ShortenURL(r.Context(), userID, req)
+	if IsValidationError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, storage.ErrShortURLExists) {
+		http.Error(w, "custom alias is already taken", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, screening.ErrBlocked) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, screening.ErrLookupUnavailable) {
+		logger.FromContext(r.Context()).Error("Error screening URL", zap.Error(err))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error saving URL", zap.Error(err))
+		http.Error(w, "Error saving URL", http.StatusInternalServerError)
+		return
+	}
+	httpStatusCode := shortenStatus(created)
 
-		pgStorage := us.Storage.(*storage.PostgreSQLStorage)
-		fmt.Println("Save to DB")
-		var mURL models.ShortenURL
+	logger.FromContext(r.Context()).Debug("URL shortened", zap.String("short_url", shortenedURL))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(shortenedURL)))
+	w.WriteHeader(httpStatusCode)
+	_, err = w.Write([]byte(shortenedURL))
 
-		mURL.ShortURL = cfg.BaseURL + "/" + id
-		mURL.OriginalURL = string(url)
-		mURL.UserID = userID
+	if err != nil {
+		http.Error(w, "Error writing response", http.StatusInternalServerError)
+		return
+	}
+}
 
-		fmt.Printf("Received URL to save: id=%s, origURL %s, userID %d \n", mURL.ShortURL, mURL.OriginalURL, mURL.UserID)
+// generateIDAttempts количество попыток сгенерировать незанятый идентификатор
+const generateIDAttempts = 3
 
-		shortURL, err := pgStorage.InsertURL(mURL)
-		if err != nil && shortURL == "" {
-			httpStatusCode = http.StatusConflict
-			shortURL, err = pgStorage.GetShortURL(string(url))
-			if err != nil {
-				logger.Log.Error("Error get Original URL", zap.Error(err))
-				return
-			}
+// saveShortenURL сохраняет URL в хранилище и в файл. Если идентификатор не задан, он генерируется.
+// Если URL уже сокращен в пределах политики дедупликации, возвращает идентификатор прежней ссылки и статус 409
+func (us *URLShortener) saveShortenURL(ctx context.Context, mURL models.ShortenURL) (string, int, error) {
+	generated := mURL.ShortURL == ""
+	var err error
+	for attempt := 0; attempt < generateIDAttempts; attempt++ {
+		if generated {
+			mURL.ShortURL = us.GenerateID()
 		}
-		shortenedURL = shortURL
-	} else {
-		urlData := &URLData{
-			UUID:        us.GenerateUUID(),
-			ShortURL:    shortenedURL,
-			OriginalURL: string(url),
+		err = us.Storage.SaveURL(ctx, mURL)
+		if !generated || !errors.Is(err, storage.ErrShortURLExists) {
+			break
 		}
-		fmt.Println("Save to FILE")
-		// сохранение URL в мапу
-		err = us.Storage.SaveURL(id, string(url))
+	}
+	if errors.Is(err, storage.ErrAlreadyExistURL) {
+		shortURL, err := us.Storage.GetShortURL(ctx, mURL.UserID, mURL.OriginalURL)
 		if err != nil {
-			logger.Log.Error("Error saving URL", zap.Error(err))
-			http.Error(w, "Error saving URL", http.StatusInternalServerError)
-			return
+			logger.FromContext(ctx).Error("Error get Original URL", zap.Error(err))
+			return "", 0, err
 		}
+		return shortURL, http.StatusConflict, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
 
-		if err := us.fileStorage.SaveToFileURL(urlData); err != nil {
-			logger.Log.Error("Error saving URL data in file", zap.Error(err))
-			return
+	if us.fileStorage != nil {
+		urlData := &URLData{
+			UUID:        us.GenerateUUID(),
+			ShortURL:    mURL.ShortURL,
+			OriginalURL: mURL.OriginalURL,
+			UserID:      mURL.UserID,
+			ExpiresAt:   timePtr(mURL.ExpiresAt),
+		}
+		if err := us.SaveToFile(ctx, urlData); err != nil {
+			return "", 0, err
 		}
 	}
+	return mURL.ShortURL, http.StatusCreated, nil
+}
 
-	fmt.Printf("Original URL: %s\n", url)
-	fmt.Printf("Shortened URL: %s\n", shortenedURL)
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(shortenedURL)))
-	w.WriteHeader(httpStatusCode)
-	_, err = w.Write([]byte(shortenedURL))
-
-	if err != nil {
-		http.Error(w, "Error writing response", http.StatusInternalServerError)
-		return
+// shortenStatus 201 для новой ссылки и 409, если URL уже был сокращен
+func shortenStatus(created bool) int {
+	if created {
+		return http.StatusCreated
 	}
+	return http.StatusConflict
 }
 
-func (us *URLShortener) SaveToFile(urlData *URLData) error {
+func (us *URLShortener) buildShortURL(id string) string {
+	return us.config.BaseURL + "/" + id
+}
 
-	if err := us.fileStorage.SaveToFileURL(urlData); err != nil {
-		logger.Log.Error("Error saving URL data in file", zap.Error(err))
+func (us *URLShortener) SaveToFile(ctx context.Context, urlData *URLData) error {
+	err := us.fileOp(ctx, "save_url", func() error {
+		return us.fileStorage.SaveToFileURL(urlData)
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Error saving URL data in file", zap.Error(err))
 		return err
 	}
 
 	return nil
 }
 
+// fileOp выполняет операцию с файлом хранилища в отдельном спане трассировки
+func (us *URLShortener) fileOp(ctx context.Context, name string, op func() error) error {
+	_, span := tracing.Start(ctx, "producer."+name)
+	err := op()
+	tracing.End(span, err)
+	return err
+}
+
 func (us *URLShortener) RedirectURLHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	URLId := strings.TrimPrefix(r.URL.Path, "/")
-	cfg := us.config
-	var originalURL string
-	var err error
-	if cfg.DSN != "" {
-		shortURL := cfg.BaseURL + r.URL.Path
-
-		pgStorage := us.Storage.(*storage.PostgreSQLStorage)
 
-		originalURL, err = pgStorage.GetURL(shortURL)
-		if err != nil {
-			logger.Log.Error("Error get row from DB", zap.Error(err))
-		}
-
-	} else {
-		// fmt.Printf("redirect url %s \n", r.Host+r.URL.String())
-		originalURL, err = us.Storage.GetURL(URLId)
-		if err != nil {
-			http.Error(w, "URL not found", http.StatusBadRequest)
-			return
-		}
+	url, err := us.ResolveURL(r.Context(), URLId)
+	if errors.Is(err, storage.ErrURLNotFound) {
+		http.Error(w, "URL not found", http.StatusBadRequest)
+		return
 	}
-	// Выполняем перенаправление на оригинальный URL
-	fmt.Printf("RedirectURLHandler. original URL=%s \n", originalURL)
-	if originalURL == "" {
+	if errors.Is(err, ErrURLGone) {
 		w.WriteHeader(http.StatusGone)
-	} else {
-		w.Header().Set("Location", originalURL)
-		w.WriteHeader(http.StatusTemporaryRedirect)
+		return
 	}
-
+	if errors.Is(err, screening.ErrBlocked) {
+		http.Error(w, "destination is blocked", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error get URL from storage", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// Выполняем перенаправление на оригинальный URL
+	logger.FromContext(r.Context()).Debug("Redirect", zap.String("short_url", URLId), zap.String("original_url", url.OriginalURL))
+	w.Header().Set("Location", url.OriginalURL)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+	us.clickRecorder.Record(r.Context(), newClick(r, URLId))
 }
 
 func (us *URLShortener) APIShortenerURL(w http.ResponseWriter, r *http.Request) {
@@ -234,60 +274,37 @@ func (us *URLShortener) APIShortenerURL(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	defer r.Body.Close()
-	url := req.URL
 
-	id := us.GenerateID()
-	cfg := us.config
-
-	shortenedURL := cfg.BaseURL + "/" + id
-
-	httpStatusCode := http.StatusCreated
-	if cfg.DSN != "" {
-		userID, err := us.GetNextUserID(w, r)
-		fmt.Printf("shortener. user %d; err %s \n", userID, err)
-		if err != nil {
-			// w.WriteHeader(http.StatusBadRequest)
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		pgStorage := us.Storage.(*storage.PostgreSQLStorage)
-
-		var mURL models.ShortenURL
-		mURL.OriginalURL = string(url)
-		mURL.ShortURL = shortenedURL
-		mURL.UserID = userID
-
-		shortURL, err := pgStorage.InsertURL(mURL)
-		if err != nil && shortURL == "" {
-			httpStatusCode = http.StatusConflict
-			shortURL, err = pgStorage.GetShortURL(string(url))
-			if err != nil {
-				logger.Log.Error("Error get Original URL", zap.Error(err))
-				return
-			}
-		}
-		shortenedURL = shortURL
-
-	} else {
-		urlData := &URLData{
-			UUID:        us.GenerateUUID(),
-			ShortURL:    shortenedURL,
-			OriginalURL: string(url),
-		}
-		// сохранение URL в мапу
-		err := us.Storage.SaveURL(id, string(url))
-		if err != nil {
-			logger.Log.Error("Error saving URL", zap.Error(err))
-			http.Error(w, "Error saving URL", http.StatusInternalServerError)
-			return
-		}
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
 
-		if err := us.fileStorage.SaveToFileURL(urlData); err != nil {
-			logger.Log.Error("Error saving URL data in file", zap.Error(err))
-			return
-		}
+	shortenedURL, created, err := us.ShortenURL(r.Context(), userID, req)
+	if IsValidationError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, storage.ErrShortURLExists) {
+		http.Error(w, "custom alias is already taken", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, screening.ErrBlocked) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, screening.ErrLookupUnavailable) {
+		logger.FromContext(r.Context()).Error("Error screening URL", zap.Error(err))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
 	}
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error saving URL", zap.Error(err))
+		http.Error(w, "Error saving URL", http.StatusInternalServerError)
+		return
+	}
+	httpStatusCode := shortenStatus(created)
 
 	resp := models.Response{
 		Result: shortenedURL,
@@ -313,34 +330,27 @@ func (us *URLShortener) GetAllURLByUserID(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	cfg := us.config
-	if cfg.DSN != "" {
-		userID, err := us.GetNextUserID(w, r)
-		fmt.Printf("GetAllURLByUserID. user %d; err %s \n", userID, err)
-		if err != nil {
-			logger.Log.Error("GetAllURLByUserID. Error GetNextUserID", zap.Error(err))
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	identity, ok := requireIdentity(w, r)
+	if !ok {
+		return
+	}
+	userID := identity.UserID
 
-		// Получите все URL пользователя из базы данных
-		urls, err := us.GetUserURLs(userID)
-		if err != nil {
-			logger.Log.Error("Error getting user URLs from database", zap.Error(err))
-			return
-		}
+	// Получаем все URL пользователя из хранилища
+	urls, err := us.UserURLs(r.Context(), userID)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error getting user URLs from storage", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
-		if urls == nil {
-			w.WriteHeader(http.StatusNoContent)
-		} else {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(urls)
-		}
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
+	if len(urls) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(urls)
 }
 
 func (us *URLShortener) DeleteShortenedURLs(w http.ResponseWriter, r *http.Request) {
@@ -348,11 +358,6 @@ func (us *URLShortener) DeleteShortenedURLs(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	go us.ProcessDeletedURLs()
-
-	cfg := us.config
-	hostURL := r.Host
-
 	// Получаю список сокращенных URL из body
 	var urlsToDelete []string
 	decoder := json.NewDecoder(r.Body)
@@ -363,28 +368,18 @@ func (us *URLShortener) DeleteShortenedURLs(w http.ResponseWriter, r *http.Reque
 	defer r.Body.Close()
 
 	// Получаю userID
-	userID, err := us.GetNextUserID(w, r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	identity, ok := requireIdentity(w, r)
+	if !ok {
 		return
 	}
-	fmt.Printf("DeleteShortenedURLs. UserID %d \n", userID)
+	userID := identity.UserID
+	logger.FromContext(r.Context()).Debug("URLs to delete", zap.Int("user_id", userID), zap.Strings("urls", urlsToDelete))
 
-	if cfg.BaseURL != "" {
-		hostURL = cfg.BaseURL
-	}
-	fmt.Printf("DeleteShortenedURLs. URLs to delete %s \n", urlsToDelete)
-
-	for _, shortURL := range urlsToDelete {
-		fullURL := hostURL + "/" + shortURL
-		// Передаю userID и URL в канал на удаление
-		us.deleteCh <- struct {
-			UserID int
-			URL    string
-		}{
-			UserID: userID,
-			URL:    fullURL,
-		}
+	// Передаю userID и идентификаторы URL в очередь на удаление
+	if err := us.DeleteUserURLs(r.Context(), userID, urlsToDelete); err != nil {
+		logger.FromContext(r.Context()).Error("Error enqueue URLs deletion", zap.Error(err))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
 	}
 
 	w.WriteHeader(http.StatusAccepted)
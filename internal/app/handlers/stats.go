@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/logger"
+	"go.uber.org/zap"
+)
+
+// parseTrustedSubnet разбирает TrustedSubnet из настроек. Пустая или неверная подсеть закрывает доступ всем
+func parseTrustedSubnet(cidr string) *net.IPNet {
+	if cidr == "" {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		logger.Log.Error("Invalid trusted subnet, internal endpoints are disabled", zap.String("cidr", cidr), zap.Error(err))
+		return nil
+	}
+	return subnet
+}
+
+// TrustedSubnetMiddleware пропускает только запросы, у которых X-Real-IP входит в доверенную подсеть.
+// Остальные, как и все запросы при пустой подсети, получают 403
+func (us *URLShortener) TrustedSubnetMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+		if us.trustedSubnet == nil || ip == nil || !us.trustedSubnet.Contains(ip) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// InternalStatsHandler отдает количество ссылок и пользователей сервиса
+func (us *URLShortener) InternalStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := us.Storage.GetStats(r.Context(), time.Now())
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Error getting stats", zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
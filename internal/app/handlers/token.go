@@ -2,20 +2,17 @@ package handlers
 
 import (
 	"errors"
-	"fmt"
-	"net/http"
 	"time"
 
-	"github.com/Tokebay/yandex/internal/logger"
 	"github.com/golang-jwt/jwt/v4"
-	"go.uber.org/zap"
 )
 
 const TokenExp = time.Hour * 3
-const SecretKey = "shortURL"
+
 const CookieName = "token"
 
 var ErrToken = errors.New("invalid token")
+var ErrTokenExpired = errors.New("token expired")
 var ErrParseClaims = errors.New("error ParseWithClaims")
 var ErrSignTokenString = errors.New("error create token string")
 
@@ -24,55 +21,50 @@ type Claims struct {
 	UserID int
 }
 
-func GetUserCookie(r *http.Request) (int, error) {
-	cookie, err := r.Cookie(CookieName)
-	if err != nil {
-		if errors.Is(err, http.ErrNoCookie) {
-			return 0, nil
-		}
-		logger.Log.Error("GetUserCookie. error get cookie", zap.Error(err))
-		return 0, err
-	}
-
-	userID, err := ExtractUserIDFromToken(cookie.Value)
+func ExtractUserIDFromToken(tokenString string) (int, error) {
+	claims, err := ParseToken(tokenString)
 	if err != nil {
-		return 0, fmt.Errorf("error get userID: %w", err)
+		return -1, err
 	}
-
-	return userID, nil
+	return claims.UserID, nil
 }
 
-func ExtractUserIDFromToken(tokenString string) (int, error) {
+// ParseToken проверяет токен. Для токена с верной подписью, у которого истек только срок действия,
+// возвращает утверждения вместе с ErrTokenExpired, чтобы сессию можно было продлить
+func ParseToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-
-		return []byte(SecretKey), nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, currentKeySet().keyFunc)
 	if err != nil {
-		return -1, ErrParseClaims
+		var ve *jwt.ValidationError
+		if errors.As(err, &ve) && ve.Errors == jwt.ValidationErrorExpired {
+			return claims, ErrTokenExpired
+		}
+		return nil, ErrParseClaims
 	}
 
 	if !token.Valid {
-		return -1, ErrToken
+		return nil, ErrToken
 	}
 
-	return claims.UserID, nil
+	return claims, nil
 }
 
 func BuildJWTString(userID int) (string, error) {
-	// создаём новый токен с алгоритмом подписи HS256 и утверждениями — Claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+	return BuildSessionToken(userID, TokenExp)
+}
+
+// BuildSessionToken выпускает токен пользователя со сроком действия lifetime
+func BuildSessionToken(userID int, lifetime time.Duration) (string, error) {
+	now := time.Now()
+	// создаём новый токен, подписанный активным ключом, с утверждениями — Claims
+	tokenString, err := currentKeySet().sign(Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			// когда создан токен
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenExp)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
 		},
 		UserID: userID,
 	})
-
-	tokenString, err := token.SignedString([]byte(SecretKey))
 	if err != nil {
 		return "", ErrSignTokenString
 	}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/lib/pq"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKeyStorage хранилище ключей доступа пользователей
+type APIKeyStorage interface {
+	SaveAPIKey(ctx context.Context, key models.APIKey) error
+	// GetAPIKeyByHash ищет ключ по хешу, в том числе отозванный
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error)
+	// GetUserAPIKeys возвращает действующие ключи пользователя
+	GetUserAPIKeys(ctx context.Context, userID int) ([]models.APIKey, error)
+	// RevokeAPIKey отзывает действующий ключ пользователя, иначе возвращает ErrAPIKeyNotFound
+	RevokeAPIKey(ctx context.Context, userID int, id string, revokedAt time.Time) error
+}
+
+func (ms *MapStorage) SaveAPIKey(ctx context.Context, key models.APIKey) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.apiKeys[key.ID] = key
+	ms.apiKeyHashes[key.KeyHash] = key.ID
+	if key.UserID > ms.lastUserID {
+		ms.lastUserID = key.UserID
+	}
+	return nil
+}
+
+func (ms *MapStorage) GetAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	id, ok := ms.apiKeyHashes[keyHash]
+	if !ok {
+		return models.APIKey{}, ErrAPIKeyNotFound
+	}
+	return ms.apiKeys[id], nil
+}
+
+func (ms *MapStorage) GetUserAPIKeys(ctx context.Context, userID int) ([]models.APIKey, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var keys []models.APIKey
+	for _, key := range ms.apiKeys {
+		if key.UserID == userID && !key.IsRevoked() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (ms *MapStorage) RevokeAPIKey(ctx context.Context, userID int, id string, revokedAt time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key, ok := ms.apiKeys[id]
+	if !ok || key.UserID != userID || key.IsRevoked() {
+		return ErrAPIKeyNotFound
+	}
+	key.RevokedAt = revokedAt
+	ms.apiKeys[id] = key
+	return nil
+}
+
+func (s *PostgreSQLStorage) SaveAPIKey(ctx context.Context, key models.APIKey) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO api_keys (id, user_id, name, key_hash, scopes, created_at, revoked_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		key.ID, key.UserID, key.Name, key.KeyHash, scopesArray(key.Scopes), key.CreatedAt, nullTime(key.RevokedAt))
+	return err
+}
+
+// scopesArray без scopes ключ дает все права. pq.Array для nil пишет NULL, а столбец NOT NULL, поэтому пишем пустой массив
+func scopesArray(scopes []string) interface{} {
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return pq.Array(scopes)
+}
+
+func (s *PostgreSQLStorage) GetAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT id, user_id, name, key_hash, scopes, created_at, revoked_at
+		FROM api_keys WHERE key_hash = $1`, keyHash)
+	key, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *PostgreSQLStorage) GetUserAPIKeys(ctx context.Context, userID int) ([]models.APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, name, key_hash, scopes, created_at, revoked_at
+		FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *PostgreSQLStorage) RevokeAPIKey(ctx context.Context, userID int, id string, revokedAt time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`, revokedAt, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKey(row rowScanner) (models.APIKey, error) {
+	var key models.APIKey
+	var revokedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.KeyHash, pq.Array(&key.Scopes), &key.CreatedAt, &revokedAt)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+	key.RevokedAt = revokedAt.Time
+	return key, nil
+}
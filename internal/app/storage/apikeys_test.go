@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScopesArray(t *testing.T) {
+	value, err := scopesArray(nil).(driver.Valuer).Value()
+	require.NoError(t, err)
+	assert.Equal(t, "{}", value)
+}
+
+func TestPostgreSQLSaveAPIKeyWithoutScopes(t *testing.T) {
+	s := newTestPostgreSQLStorage(t)
+	ctx := context.Background()
+
+	key := models.APIKey{
+		ID:        "test-" + time.Now().Format("150405.000000000"),
+		UserID:    1,
+		Name:      "all scopes",
+		KeyHash:   "hash-" + time.Now().Format("150405.000000000"),
+		CreatedAt: time.Now().UTC(),
+	}
+	require.NoError(t, s.SaveAPIKey(ctx, key))
+
+	saved, err := s.GetAPIKeyByHash(ctx, key.KeyHash)
+	require.NoError(t, err)
+	assert.Empty(t, saved.Scopes)
+	assert.True(t, saved.HasScope("delete"))
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"go.uber.org/zap"
+)
+
+const dayLayout = "2006-01-02"
+
+// ClickStorage хранилище событий переходов по коротким ссылкам
+type ClickStorage interface {
+	SaveClicks(ctx context.Context, clicks []models.Click) error
+	// GetClickStats возвращает общее число переходов, переходы по дням начиная с since
+	// и topReferrers самых частых источников
+	GetClickStats(ctx context.Context, shortURL string, since time.Time, topReferrers int) (models.ClickStats, error)
+}
+
+func (ms *MapStorage) SaveClicks(ctx context.Context, clicks []models.Click) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, click := range clicks {
+		ms.clicks[click.ShortURL] = append(ms.clicks[click.ShortURL], click)
+	}
+	return nil
+}
+
+func (ms *MapStorage) GetClickStats(ctx context.Context, shortURL string, since time.Time, topReferrers int) (models.ClickStats, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	stats := models.ClickStats{
+		ShortURL:     shortURL,
+		Daily:        []models.DailyClicks{},
+		TopReferrers: []models.ReferrerClicks{},
+	}
+	daily := make(map[string]int)
+	referrers := make(map[string]int)
+	for _, click := range ms.clicks[shortURL] {
+		stats.Total++
+		if click.Referrer != "" {
+			referrers[click.Referrer]++
+		}
+		if !click.ClickedAt.Before(since) {
+			daily[click.ClickedAt.UTC().Format(dayLayout)]++
+		}
+	}
+
+	for day, count := range daily {
+		stats.Daily = append(stats.Daily, models.DailyClicks{Date: day, Clicks: count})
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
+
+	for referrer, count := range referrers {
+		stats.TopReferrers = append(stats.TopReferrers, models.ReferrerClicks{Referrer: referrer, Clicks: count})
+	}
+	sort.Slice(stats.TopReferrers, func(i, j int) bool {
+		if stats.TopReferrers[i].Clicks != stats.TopReferrers[j].Clicks {
+			return stats.TopReferrers[i].Clicks > stats.TopReferrers[j].Clicks
+		}
+		return stats.TopReferrers[i].Referrer < stats.TopReferrers[j].Referrer
+	})
+	if len(stats.TopReferrers) > topReferrers {
+		stats.TopReferrers = stats.TopReferrers[:topReferrers]
+	}
+
+	return stats, nil
+}
+
+func (s *PostgreSQLStorage) SaveClicks(ctx context.Context, clicks []models.Click) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO clicks (short_url, clicked_at, referrer, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, click := range clicks {
+		_, err := stmt.ExecContext(ctx, click.ShortURL, click.ClickedAt, click.Referrer, click.UserAgent, click.IP)
+		if err != nil {
+			logger.FromContext(ctx).Error("Error insert click", zap.Error(err))
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgreSQLStorage) GetClickStats(ctx context.Context, shortURL string, since time.Time, topReferrers int) (models.ClickStats, error) {
+	stats := models.ClickStats{
+		ShortURL:     shortURL,
+		Daily:        []models.DailyClicks{},
+		TopReferrers: []models.ReferrerClicks{},
+	}
+
+	err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM clicks WHERE short_url = $1", shortURL).Scan(&stats.Total)
+	if err != nil {
+		logger.FromContext(ctx).Error("Error count clicks", zap.Error(err))
+		return stats, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*)
+		FROM clicks
+		WHERE short_url = $1 AND clicked_at >= $2
+		GROUP BY day
+		ORDER BY day`, shortURL, since)
+	if err != nil {
+		logger.FromContext(ctx).Error("Error select daily clicks", zap.Error(err))
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var daily models.DailyClicks
+		if err := rows.Scan(&daily.Date, &daily.Clicks); err != nil {
+			return stats, err
+		}
+		stats.Daily = append(stats.Daily, daily)
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	refRows, err := s.db.QueryContext(ctx, `
+		SELECT referrer, count(*) AS clicks
+		FROM clicks
+		WHERE short_url = $1 AND referrer != ''
+		GROUP BY referrer
+		ORDER BY clicks DESC, referrer
+		LIMIT $2`, shortURL, topReferrers)
+	if err != nil {
+		logger.FromContext(ctx).Error("Error select top referrers", zap.Error(err))
+		return stats, err
+	}
+	defer refRows.Close()
+	for refRows.Next() {
+		var referrer models.ReferrerClicks
+		if err := refRows.Scan(&referrer.Referrer, &referrer.Clicks); err != nil {
+			return stats, err
+		}
+		stats.TopReferrers = append(stats.TopReferrers, referrer)
+	}
+
+	return stats, refRows.Err()
+}
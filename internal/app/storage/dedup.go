@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// DedupScope в каких пределах повторное сокращение того же original_url возвращает прежнюю ссылку
+type DedupScope string
+
+const (
+	// DedupGlobal одна ссылка на original_url для всех пользователей
+	DedupGlobal DedupScope = "global"
+	// DedupUser у каждого пользователя своя ссылка на original_url
+	DedupUser DedupScope = "user"
+	// DedupNone каждое сокращение создает новую ссылку
+	DedupNone DedupScope = "none"
+)
+
+// globalDedupOwner владелец ключа дедупликации ссылок, общих для всех пользователей
+const globalDedupOwner = 0
+
+func ParseDedupScope(scope string) (DedupScope, error) {
+	switch DedupScope(scope) {
+	case DedupGlobal, DedupUser, DedupNone:
+		return DedupScope(scope), nil
+	}
+	return "", fmt.Errorf("unknown dedup scope %q", scope)
+}
+
+// owner в пределах кого original_url ссылки уникален. ok ложно, если ссылка не участвует в дедупликации.
+// Ссылки, созданные при другой политике, сохраняют прежнего владельца
+func (scope DedupScope) owner(userID int) (int, bool) {
+	switch scope {
+	case DedupUser:
+		return userID, true
+	case DedupNone:
+		return 0, false
+	}
+	return globalDedupOwner, true
+}
+
+// dedupOwner владелец для столбца dedup_owner, NULL для ссылок вне дедупликации
+func (scope DedupScope) dedupOwner(userID int) sql.NullInt64 {
+	owner, ok := scope.owner(userID)
+	return sql.NullInt64{Int64: int64(owner), Valid: ok}
+}
+
+// originalKey ключ уникальности original_url в MapStorage
+type originalKey struct {
+	owner       int
+	originalURL string
+}
+
+// originalKey ключ ссылки пользователя. ok ложно, если ссылка не участвует в дедупликации
+func (scope DedupScope) originalKey(userID int, originalURL string) (originalKey, bool) {
+	owner, ok := scope.owner(userID)
+	return originalKey{owner: owner, originalURL: originalURL}, ok
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/pressly/goose/v3"
+)
+
+var ErrMigrationVersion = errors.New("unexpected migration version")
+
+func lastMigrationVersion(dir string) (int64, error) {
+	migrations, err := goose.CollectMigrations(dir, 0, goose.MaxVersion)
+	if err != nil {
+		return 0, err
+	}
+	last, err := migrations.Last()
+	if err != nil {
+		return 0, err
+	}
+	return last.Version, nil
+}
+
+// CheckMigrations сверяет версию схемы в базе с последней миграцией. В отличие от goose.GetDBVersion,
+// только читает таблицу версий и не создает ее
+func (s *PostgreSQLStorage) CheckMigrations(ctx context.Context) error {
+	var version sql.NullInt64
+	query := fmt.Sprintf("SELECT MAX(version_id) FROM %s WHERE is_applied", goose.TableName())
+	if err := s.db.QueryRowContext(ctx, query).Scan(&version); err != nil {
+		return err
+	}
+	if version.Int64 != s.migrationVersion {
+		return fmt.Errorf("%w: %d, expected %d", ErrMigrationVersion, version.Int64, s.migrationVersion)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/models"
+)
+
+var ErrIdempotencyKeyExists = errors.New("idempotency key already used")
+
+type idempotencyKey struct {
+	userID int
+	key    string
+}
+
+// IdempotencyStorage запросы с заголовком Idempotency-Key. Ключ уникален в пределах пользователя
+type IdempotencyStorage interface {
+	// ReserveIdempotencyKey сохраняет запрос без ответа. Если у пользователя уже есть неистекшая запись
+	// с этим ключом, возвращает ее и ErrIdempotencyKeyExists. Истекшая запись заменяется
+	ReserveIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) (models.IdempotencyRecord, error)
+	// CompleteIdempotencyKey сохраняет ответ на зарезервированный запрос
+	CompleteIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) error
+	// DeleteIdempotencyKey освобождает ключ, чтобы запрос можно было повторить
+	DeleteIdempotencyKey(ctx context.Context, userID int, key string) error
+	// DeleteExpiredIdempotencyKeys удаляет записи, истекшие раньше before, и возвращает их количество
+	DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error)
+}
+
+func (ms *MapStorage) ReserveIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) (models.IdempotencyRecord, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	id := idempotencyKey{userID: record.UserID, key: record.Key}
+	if existing, ok := ms.idempotency[id]; ok && existing.ExpiresAt.After(record.CreatedAt) {
+		return existing, ErrIdempotencyKeyExists
+	}
+	ms.idempotency[id] = record
+	return record, nil
+}
+
+func (ms *MapStorage) CompleteIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.idempotency[idempotencyKey{userID: record.UserID, key: record.Key}] = record
+	return nil
+}
+
+func (ms *MapStorage) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.idempotency, idempotencyKey{userID: userID, key: key})
+	return nil
+}
+
+func (ms *MapStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	deleted := 0
+	for id, record := range ms.idempotency {
+		if !record.ExpiresAt.After(before) {
+			delete(ms.idempotency, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *PostgreSQLStorage) ReserveIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) (models.IdempotencyRecord, error) {
+	// истекшую запись перезаписываем, живую не трогаем
+	res, err := s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (user_id, key, request_hash, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status_code = 0, content_type = '', body = NULL,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= EXCLUDED.created_at`,
+		record.UserID, record.Key, record.RequestHash, record.CreatedAt, record.ExpiresAt)
+	if err != nil {
+		return models.IdempotencyRecord{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return models.IdempotencyRecord{}, err
+	}
+	if n > 0 {
+		return record, nil
+	}
+
+	existing := models.IdempotencyRecord{UserID: record.UserID, Key: record.Key}
+	err = s.db.QueryRowContext(ctx, `SELECT request_hash, status_code, content_type, body, created_at, expires_at
+		FROM idempotency_keys WHERE user_id = $1 AND key = $2`, record.UserID, record.Key).
+		Scan(&existing.RequestHash, &existing.StatusCode, &existing.ContentType, &existing.Body, &existing.CreatedAt, &existing.ExpiresAt)
+	// запись успели удалить — для клиента это то же, что запрос в процессе
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return models.IdempotencyRecord{}, err
+	}
+	return existing, ErrIdempotencyKeyExists
+}
+
+func (s *PostgreSQLStorage) CompleteIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE idempotency_keys SET status_code = $1, content_type = $2, body = $3
+		WHERE user_id = $4 AND key = $5 AND request_hash = $6`,
+		record.StatusCode, record.ContentType, record.Body, record.UserID, record.Key, record.RequestHash)
+	return err
+}
+
+func (s *PostgreSQLStorage) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2`, userID, key)
+	return err
+}
+
+func (s *PostgreSQLStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/metrics"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/Tokebay/yandex/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentedStorage измеряет длительность и ошибки операций хранилища и открывает на каждую операцию спан трассировки
+type InstrumentedStorage struct {
+	next    URLStorage
+	backend string
+}
+
+// NewInstrumentedStorage оборачивает хранилище. backend — метка хранилища в метриках
+func NewInstrumentedStorage(next URLStorage, backend string) *InstrumentedStorage {
+	return &InstrumentedStorage{next: next, backend: backend}
+}
+
+var backendKey = attribute.Key("storage.backend")
+
+// expectedErrors — ответы хранилища на запрос пользователя, а не сбои, и в ошибках не учитываются
+var expectedErrors = []error{
+	ErrAlreadyExistURL,
+	ErrURLNotFound,
+	ErrShortURLExists,
+	ErrAPIKeyNotFound,
+	ErrUserNotFound,
+	ErrEmailTaken,
+	ErrAlreadyRegistered,
+	ErrIdempotencyKeyExists,
+}
+
+type storageOperation struct {
+	backend   string
+	name      string
+	startTime time.Time
+	span      trace.Span
+}
+
+func (s *InstrumentedStorage) start(ctx context.Context, name string) (context.Context, storageOperation) {
+	ctx, span := tracing.Start(ctx, "storage."+name, trace.WithAttributes(
+		semconv.DBOperation(name),
+		backendKey.String(s.backend),
+	))
+	return ctx, storageOperation{backend: s.backend, name: name, startTime: time.Now(), span: span}
+}
+
+func (op storageOperation) end(err error) {
+	failed := err != nil
+	for _, expected := range expectedErrors {
+		if errors.Is(err, expected) {
+			failed = false
+			break
+		}
+	}
+	metrics.ObserveStorage(op.backend, op.name, op.startTime, failed)
+	if failed {
+		tracing.End(op.span, err)
+		return
+	}
+	op.span.End()
+}
+
+func (s *InstrumentedStorage) SaveURL(ctx context.Context, url models.ShortenURL) error {
+	ctx, op := s.start(ctx, "save_url")
+	err := s.next.SaveURL(ctx, url)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) SaveBatchURL(ctx context.Context, urls []models.ShortenURL) ([]string, error) {
+	ctx, op := s.start(ctx, "save_batch_url")
+	result, err := s.next.SaveBatchURL(ctx, urls)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) GetURL(ctx context.Context, shortURL string) (models.ShortenURL, error) {
+	ctx, op := s.start(ctx, "get_url")
+	result, err := s.next.GetURL(ctx, shortURL)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) GetShortURL(ctx context.Context, userID int, origURL string) (string, error) {
+	ctx, op := s.start(ctx, "get_short_url")
+	result, err := s.next.GetShortURL(ctx, userID, origURL)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) GetUserURLs(ctx context.Context, userID int) ([]models.ShortenURL, error) {
+	ctx, op := s.start(ctx, "get_user_urls")
+	result, err := s.next.GetUserURLs(ctx, userID)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) InsertUser(ctx context.Context) (int, error) {
+	ctx, op := s.start(ctx, "insert_user")
+	result, err := s.next.InsertUser(ctx)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) MarkURLAsDeleted(ctx context.Context, userID int, shortURLs []string) error {
+	ctx, op := s.start(ctx, "mark_url_as_deleted")
+	err := s.next.MarkURLAsDeleted(ctx, userID, shortURLs)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) DeleteExpiredURLs(ctx context.Context, before time.Time) ([]string, error) {
+	ctx, op := s.start(ctx, "delete_expired_urls")
+	result, err := s.next.DeleteExpiredURLs(ctx, before)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) Ping(ctx context.Context) error {
+	ctx, op := s.start(ctx, "ping")
+	err := s.next.Ping(ctx)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) SaveClicks(ctx context.Context, clicks []models.Click) error {
+	ctx, op := s.start(ctx, "save_clicks")
+	err := s.next.SaveClicks(ctx, clicks)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) GetClickStats(ctx context.Context, shortURL string, since time.Time, topReferrers int) (models.ClickStats, error) {
+	ctx, op := s.start(ctx, "get_click_stats")
+	result, err := s.next.GetClickStats(ctx, shortURL, since, topReferrers)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) SaveAPIKey(ctx context.Context, key models.APIKey) error {
+	ctx, op := s.start(ctx, "save_api_key")
+	err := s.next.SaveAPIKey(ctx, key)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) GetAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	ctx, op := s.start(ctx, "get_api_key_by_hash")
+	result, err := s.next.GetAPIKeyByHash(ctx, keyHash)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) GetUserAPIKeys(ctx context.Context, userID int) ([]models.APIKey, error) {
+	ctx, op := s.start(ctx, "get_user_api_keys")
+	result, err := s.next.GetUserAPIKeys(ctx, userID)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) RevokeAPIKey(ctx context.Context, userID int, id string, revokedAt time.Time) error {
+	ctx, op := s.start(ctx, "revoke_api_key")
+	err := s.next.RevokeAPIKey(ctx, userID, id, revokedAt)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) RegisterUser(ctx context.Context, user models.User) error {
+	ctx, op := s.start(ctx, "register_user")
+	err := s.next.RegisterUser(ctx, user)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) GetUser(ctx context.Context, userID int) (models.User, error) {
+	ctx, op := s.start(ctx, "get_user")
+	result, err := s.next.GetUser(ctx, userID)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	ctx, op := s.start(ctx, "get_user_by_email")
+	result, err := s.next.GetUserByEmail(ctx, email)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) UpdatePassword(ctx context.Context, userID int, passwordHash string) error {
+	ctx, op := s.start(ctx, "update_password")
+	err := s.next.UpdatePassword(ctx, userID, passwordHash)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) MergeUsers(ctx context.Context, fromUserID, toUserID int) error {
+	ctx, op := s.start(ctx, "merge_users")
+	err := s.next.MergeUsers(ctx, fromUserID, toUserID)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) GetStats(ctx context.Context, now time.Time) (models.Stats, error) {
+	ctx, op := s.start(ctx, "get_stats")
+	result, err := s.next.GetStats(ctx, now)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) ReserveIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) (models.IdempotencyRecord, error) {
+	ctx, op := s.start(ctx, "reserve_idempotency_key")
+	result, err := s.next.ReserveIdempotencyKey(ctx, record)
+	op.end(err)
+	return result, err
+}
+
+func (s *InstrumentedStorage) CompleteIdempotencyKey(ctx context.Context, record models.IdempotencyRecord) error {
+	ctx, op := s.start(ctx, "complete_idempotency_key")
+	err := s.next.CompleteIdempotencyKey(ctx, record)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	ctx, op := s.start(ctx, "delete_idempotency_key")
+	err := s.next.DeleteIdempotencyKey(ctx, userID, key)
+	op.end(err)
+	return err
+}
+
+func (s *InstrumentedStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	ctx, op := s.start(ctx, "delete_expired_idempotency_keys")
+	result, err := s.next.DeleteExpiredIdempotencyKeys(ctx, before)
+	op.end(err)
+	return result, err
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/logger"
+	"github.com/Tokebay/yandex/internal/models"
+	"go.uber.org/zap"
+)
+
+type StatsStorage interface {
+	// GetStats считает ссылки и пользователей. Истекшими считаются не удаленные ссылки с expires_at не позже now
+	GetStats(ctx context.Context, now time.Time) (models.Stats, error)
+}
+
+func (ms *MapStorage) GetStats(ctx context.Context, now time.Time) (models.Stats, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	stats := models.Stats{URLs: len(ms.mapping)}
+	users := make(map[int]struct{}, len(ms.users))
+	for _, url := range ms.mapping {
+		switch {
+		case url.DeletedFlag:
+			stats.Deleted++
+		case url.IsExpired(now):
+			stats.Expired++
+		}
+		users[url.UserID] = struct{}{}
+	}
+	for id, user := range ms.users {
+		if user.IsRegistered() {
+			users[id] = struct{}{}
+		}
+	}
+	stats.Users = len(users)
+	return stats, nil
+}
+
+func (s *PostgreSQLStorage) GetStats(ctx context.Context, now time.Time) (models.Stats, error) {
+	var stats models.Stats
+	err := s.db.QueryRowContext(ctx, `SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE is_deleted),
+			COUNT(*) FILTER (WHERE NOT is_deleted AND expires_at <= $1)
+		FROM shorten_urls`, now).Scan(&stats.URLs, &stats.Deleted, &stats.Expired)
+	if err != nil {
+		logger.FromContext(ctx).Error("Error counting urls", zap.Error(err))
+		return models.Stats{}, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users_links u
+		WHERE u.registered_at IS NOT NULL
+			OR EXISTS (SELECT 1 FROM shorten_urls s WHERE s.user_id = u.user_id)`).Scan(&stats.Users)
+	if err != nil {
+		logger.FromContext(ctx).Error("Error counting users", zap.Error(err))
+		return models.Stats{}, err
+	}
+	return stats, nil
+}
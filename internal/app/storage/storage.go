@@ -1,61 +1,303 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/Tokebay/yandex/internal/logger"
 	"github.com/Tokebay/yandex/internal/models"
-	"github.com/jackc/pgx"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
 	"github.com/pressly/goose/v3"
 	"go.uber.org/zap"
 )
 
+// URLStorage общий интерфейс хранилища сокращенных URL.
+// ShortURL во всех методах — идентификатор короткой ссылки (без BaseURL).
 type URLStorage interface {
-	SaveURL(id, url string) error
-	GetURL(id string) (string, error)
+	// SaveURL сохраняет URL пользователя. Если по политике дедупликации такой original_url уже есть,
+	// возвращает ErrAlreadyExistURL, если занят short_url — ErrShortURLExists. Удаленные и истекшие ссылки
+	// в дедупликации не участвуют: для них создается новая ссылка
+	SaveURL(ctx context.Context, url models.ShortenURL) error
+	// SaveBatchURL сохраняет пачку URL. Возвращает идентификаторы в порядке входных данных,
+	// для уже существующих URL возвращается их идентификатор и ошибка ErrAlreadyExistURL.
+	// Если занят хотя бы один short_url, ничего не сохраняется и возвращается ErrShortURLExists
+	SaveBatchURL(ctx context.Context, urls []models.ShortenURL) ([]string, error)
+	// GetURL ищет запись по идентификатору, в том числе удаленную
+	GetURL(ctx context.Context, shortURL string) (models.ShortenURL, error)
+	// GetShortURL ищет идентификатор по оригинальному URL среди ссылок, видимых пользователю по политике дедупликации
+	GetShortURL(ctx context.Context, userID int, origURL string) (string, error)
+	GetUserURLs(ctx context.Context, userID int) ([]models.ShortenURL, error)
+	InsertUser(ctx context.Context) (int, error)
+	// MarkURLAsDeleted помечает ссылки пользователя удаленными и убирает их из дедупликации
+	MarkURLAsDeleted(ctx context.Context, userID int, shortURLs []string) error
+	// DeleteExpiredURLs удаляет ссылки, срок жизни которых истек раньше before, вместе с их переходами
+	// и возвращает их идентификаторы
+	DeleteExpiredURLs(ctx context.Context, before time.Time) ([]string, error)
+	Ping(ctx context.Context) error
+
+	ClickStorage
+	APIKeyStorage
+	AccountStorage
+	StatsStorage
+	IdempotencyStorage
 }
 
+var ErrAlreadyExistURL = errors.New("URLAlreadyExist")
+var ErrURLNotFound = errors.New("url not found")
+var ErrShortURLExists = errors.New("short url already exists")
+
 type MapStorage struct {
-	mapping map[string]string
-	mu      sync.RWMutex
+	mapping map[string]models.ShortenURL
+	// originals short_url по original_url в пределах владельца из политики дедупликации
+	originals  map[originalKey]string
+	dedupScope DedupScope
+	lastUserID int
+	clicks     map[string][]models.Click
+	// apiKeys ключи по id, apiKeyHashes — id ключа по хешу
+	apiKeys      map[string]models.APIKey
+	apiKeyHashes map[string]string
+	// users зарегистрированные пользователи, emails — id пользователя по email
+	users  map[int]models.User
+	emails map[string]int
+	// idempotency ответы на запросы с Idempotency-Key
+	idempotency map[idempotencyKey]models.IdempotencyRecord
+	mu          sync.RWMutex
 }
 
 func NewMapStorage() *MapStorage {
 	return &MapStorage{
-		mapping: make(map[string]string),
+		mapping:    make(map[string]models.ShortenURL),
+		originals:  make(map[originalKey]string),
+		dedupScope: DedupGlobal,
+		clicks:     make(map[string][]models.Click),
+
+		apiKeys:      make(map[string]models.APIKey),
+		apiKeyHashes: make(map[string]string),
+
+		users:  make(map[int]models.User),
+		emails: make(map[string]int),
+
+		idempotency: make(map[idempotencyKey]models.IdempotencyRecord),
 	}
 }
 
-func (ms *MapStorage) SaveURL(shortenURL, originalURL string) error {
+func (ms *MapStorage) SaveURL(ctx context.Context, url models.ShortenURL) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
-	//fmt.Printf("save id %s; url %s \n", id, url)
-	ms.mapping[shortenURL] = originalURL
-	// fmt.Printf("Saved URL: id=%s, url=%s\n", id, url)
+	return ms.saveURL(url)
+}
+
+// SetDedupScope задает политику дедупликации новых ссылок. По умолчанию DedupGlobal
+func (ms *MapStorage) SetDedupScope(scope DedupScope) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.dedupScope = scope
+}
+
+// existingShortURL ищет действующую ссылку с тем же original_url по политике дедупликации.
+// Удаленная или истекшая ссылка не находится, и новая ссылка займет ее место. Вызывается под блокировкой
+func (ms *MapStorage) existingShortURL(url models.ShortenURL) (string, bool) {
+	key, ok := ms.dedupScope.originalKey(url.UserID, url.OriginalURL)
+	if !ok {
+		return "", false
+	}
+	shortURL, ok := ms.originals[key]
+	if !ok {
+		return "", false
+	}
+	if existing := ms.mapping[shortURL]; existing.DeletedFlag || existing.IsExpired(time.Now()) {
+		return "", false
+	}
+	return shortURL, true
+}
+
+// saveURL вызывается под блокировкой
+func (ms *MapStorage) saveURL(url models.ShortenURL) error {
+	if _, ok := ms.existingShortURL(url); ok {
+		return ErrAlreadyExistURL
+	}
+	if _, ok := ms.mapping[url.ShortURL]; ok {
+		return ErrShortURLExists
+	}
+	ms.mapping[url.ShortURL] = url
+	if key, ok := ms.dedupScope.originalKey(url.UserID, url.OriginalURL); ok {
+		ms.originals[key] = url.ShortURL
+	}
+	// не выдаем повторно идентификаторы пользователей, у которых уже есть URL
+	if url.UserID > ms.lastUserID {
+		ms.lastUserID = url.UserID
+	}
+	return nil
+}
+
+// RestoreURL восстанавливает ссылку из файла. Ссылки, созданные при другой политике дедупликации,
+// сохраняются все, в дедупликации участвует первая действующая
+func (ms *MapStorage) RestoreURL(url models.ShortenURL) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.mapping[url.ShortURL]; ok {
+		return ErrShortURLExists
+	}
+	ms.mapping[url.ShortURL] = url
+	if key, ok := ms.dedupScope.originalKey(url.UserID, url.OriginalURL); ok {
+		if _, taken := ms.existingShortURL(url); !taken {
+			ms.originals[key] = url.ShortURL
+		}
+	}
+	if url.UserID > ms.lastUserID {
+		ms.lastUserID = url.UserID
+	}
 	return nil
 }
 
-func (ms *MapStorage) GetURL(shortenURL string) (string, error) {
+// deleteOriginal убирает ссылку из дедупликации. Вызывается под блокировкой
+func (ms *MapStorage) deleteOriginal(url models.ShortenURL) {
+	key, ok := ms.dedupScope.originalKey(url.UserID, url.OriginalURL)
+	if ok && ms.originals[key] == url.ShortURL {
+		delete(ms.originals, key)
+	}
+}
+
+func (ms *MapStorage) SaveBatchURL(ctx context.Context, urls []models.ShortenURL) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// сначала проверяем занятые short_url, чтобы не сохранить пачку частично
+	batchShortURLs := make(map[string]struct{}, len(urls))
+	for _, url := range urls {
+		if _, ok := ms.existingShortURL(url); ok {
+			continue
+		}
+		_, inStorage := ms.mapping[url.ShortURL]
+		_, inBatch := batchShortURLs[url.ShortURL]
+		if inStorage || inBatch {
+			return nil, fmt.Errorf("%w: %s", ErrShortURLExists, url.ShortURL)
+		}
+		batchShortURLs[url.ShortURL] = struct{}{}
+	}
+
+	var resultErr error
+	shortURLs := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if existing, ok := ms.existingShortURL(url); ok {
+			resultErr = ErrAlreadyExistURL
+			shortURLs = append(shortURLs, existing)
+			continue
+		}
+		if err := ms.saveURL(url); err != nil {
+			return nil, err
+		}
+		shortURLs = append(shortURLs, url.ShortURL)
+	}
+	return shortURLs, resultErr
+}
+
+func (ms *MapStorage) GetURL(ctx context.Context, shortURL string) (models.ShortenURL, error) {
 	ms.mu.RLock()
 	defer ms.mu.RUnlock()
 
-	url, ok := ms.mapping[shortenURL]
-	fmt.Printf("getURL %s; url %s \n", shortenURL, url)
+	url, ok := ms.mapping[shortURL]
 	if !ok {
-		return "", errors.New("url not found")
+		return models.ShortenURL{}, ErrURLNotFound
 	}
 	return url, nil
 }
 
+func (ms *MapStorage) GetShortURL(ctx context.Context, userID int, origURL string) (string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	shortURL, ok := ms.existingShortURL(models.ShortenURL{UserID: userID, OriginalURL: origURL})
+	if !ok {
+		return "", ErrURLNotFound
+	}
+	return shortURL, nil
+}
+
+func (ms *MapStorage) GetUserURLs(ctx context.Context, userID int) ([]models.ShortenURL, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var urls []models.ShortenURL
+	for _, url := range ms.mapping {
+		if url.UserID == userID && !url.DeletedFlag {
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+// RestoreLastUserID не дает повторно выдать идентификаторы до userID, сохраненные в файле
+func (ms *MapStorage) RestoreLastUserID(userID int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if userID > ms.lastUserID {
+		ms.lastUserID = userID
+	}
+}
+
+func (ms *MapStorage) InsertUser(ctx context.Context) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.lastUserID++
+	return ms.lastUserID, nil
+}
+
+func (ms *MapStorage) MarkURLAsDeleted(ctx context.Context, userID int, shortURLs []string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, shortURL := range shortURLs {
+		url, ok := ms.mapping[shortURL]
+		if !ok || url.UserID != userID {
+			continue
+		}
+		url.DeletedFlag = true
+		ms.mapping[shortURL] = url
+		ms.deleteOriginal(url)
+	}
+	return nil
+}
+
+func (ms *MapStorage) DeleteExpiredURLs(ctx context.Context, before time.Time) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var deleted []string
+	for shortURL, url := range ms.mapping {
+		if url.IsExpired(before) {
+			delete(ms.mapping, shortURL)
+			delete(ms.clicks, shortURL)
+			ms.deleteOriginal(url)
+			deleted = append(deleted, shortURL)
+		}
+	}
+	return deleted, nil
+}
+
+func (ms *MapStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
 type PostgreSQLStorage struct {
-	db *sql.DB
+	db         *sql.DB
+	dedupScope DedupScope
+	// migrationVersion версия последней миграции из migrationsDir на момент запуска
+	migrationVersion int64
 }
 
+const migrationsDir = "./database/migration"
+
 func (s *PostgreSQLStorage) Close() error {
 	if s.db != nil {
 		err := s.db.Close()
@@ -67,14 +309,6 @@ func (s *PostgreSQLStorage) Close() error {
 	return nil
 }
 
-func (s *PostgreSQLStorage) Prepare(query string) (*sql.Stmt, error) {
-	stmt, err := s.db.Prepare(query)
-	if err != nil {
-		return nil, err
-	}
-	return stmt, nil
-}
-
 func NewPostgreSQLStorage(dsn string) (*PostgreSQLStorage, error) {
 	// Выполнить миграции
 	db, err := goose.OpenDBWithDriver("pgx", dsn)
@@ -82,125 +316,265 @@ func NewPostgreSQLStorage(dsn string) (*PostgreSQLStorage, error) {
 		logger.Log.Error("Error open conn", zap.Error(err))
 		return nil, err
 	}
-	err = goose.Up(db, "./database/migration")
+	err = goose.Up(db, migrationsDir)
 	if err != nil {
 		logger.Log.Error("Error goose UP", zap.Error(err))
 		return nil, err
 	}
+	version, err := lastMigrationVersion(migrationsDir)
+	if err != nil {
+		logger.Log.Error("Error collect migrations", zap.Error(err))
+		return nil, err
+	}
 
 	// Вернуть созданный объект PostgreSQLStorage
-	return &PostgreSQLStorage{db: db}, nil
+	return &PostgreSQLStorage{db: db, dedupScope: DedupGlobal, migrationVersion: version}, nil
 }
 
-var ErrAlreadyExistURL = errors.New("URLAlreadyExist")
-
-func (s *PostgreSQLStorage) SaveURL(shortURL string, origURL string) error {
-	// ctx := context.Background()
+// SetDedupScope задает политику дедупликации новых ссылок. По умолчанию DedupGlobal.
+// Ссылки, созданные раньше, сохраняют прежнюю политику
+func (s *PostgreSQLStorage) SetDedupScope(scope DedupScope) {
+	s.dedupScope = scope
+}
 
+func (s *PostgreSQLStorage) SaveURL(ctx context.Context, url models.ShortenURL) error {
 	// Запрос использует RETURNING, поэтому нам нужно предоставить переменную для получения результата
 	var returnedShortURL string
 
-	// Выполним запрос с помощью pgx
-	err := s.db.QueryRow(`
-		 INSERT INTO shorten_urls (short_url, original_url)
-		 VALUES ($1, $2)
-		 ON CONFLICT (original_url) DO NOTHING
-		 RETURNING short_url`, shortURL, origURL).Scan(&returnedShortURL)
+	if err := s.releaseStaleOriginal(ctx, s.db, url); err != nil {
+		logger.FromContext(ctx).Error("Error release stale URL", zap.Error(err))
+		return err
+	}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO shorten_urls (short_url, original_url, user_id, expires_at, dedup_owner)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING
+		RETURNING short_url`, url.ShortURL, url.OriginalURL, url.UserID, nullTime(url.ExpiresAt),
+		s.dedupScope.dedupOwner(url.UserID)).Scan(&returnedShortURL)
 
 	if err != nil {
-		if err == pgx.ErrNoRows { // если ON CONFLICT не сработал и ни одна строка не вернулась
-			fmt.Println("rowsAffected 0")
-			return ErrAlreadyExistURL
+		if errors.Is(err, sql.ErrNoRows) { // ON CONFLICT сработал и ни одна строка не вернулась
+			return s.conflictError(ctx, s.db, url)
 		}
-		logger.Log.Error("Error insert URL to table", zap.Error(err))
+		logger.FromContext(ctx).Error("Error insert URL to table", zap.Error(err))
 		return err
 	}
 
 	return nil
 }
 
-func (s *PostgreSQLStorage) InsertUser() (int, error) {
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
 
-	var userID int
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
 
-	err := s.db.QueryRow(`INSERT INTO users_links DEFAULT VALUES RETURNING user_id`).Scan(&userID)
+// releaseStaleOriginal убирает из дедупликации удаленные и истекшие ссылки с тем же original_url,
+// чтобы повторное сокращение создало новую ссылку, а не вернуло недействующую
+func (s *PostgreSQLStorage) releaseStaleOriginal(ctx context.Context, e execer, url models.ShortenURL) error {
+	dedupOwner := s.dedupScope.dedupOwner(url.UserID)
+	if !dedupOwner.Valid {
+		return nil
+	}
+	_, err := e.ExecContext(ctx, `UPDATE shorten_urls SET dedup_owner = NULL
+		WHERE dedup_owner = $1 AND original_url = $2 AND (is_deleted OR expires_at <= $3)`,
+		dedupOwner, url.OriginalURL, time.Now())
+	return err
+}
 
+// conflictError определяет, какое уникальное ограничение сработало при вставке
+func (s *PostgreSQLStorage) conflictError(ctx context.Context, q queryRower, url models.ShortenURL) error {
+	var exists bool
+	// для ссылок вне дедупликации dedup_owner NULL и совпадений нет
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM shorten_urls WHERE dedup_owner = $1 AND original_url = $2)",
+		s.dedupScope.dedupOwner(url.UserID), url.OriginalURL).Scan(&exists)
 	if err != nil {
-		logger.Log.Error("Error Insert Users", zap.Error(err))
-		return 0, err
+		return err
 	}
+	if exists {
+		return ErrAlreadyExistURL
+	}
+	return fmt.Errorf("%w: %s", ErrShortURLExists, url.ShortURL)
+}
 
-	return userID, nil
+func (s *PostgreSQLStorage) SaveBatchURL(ctx context.Context, urls []models.ShortenURL) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	insertStmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO shorten_urls (short_url, original_url, user_id, expires_at, dedup_owner)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING
+		RETURNING short_url`)
+	if err != nil {
+		return nil, err
+	}
+	defer insertStmt.Close()
+
+	var resultErr error
+	shortURLs := make([]string, 0, len(urls))
+	for _, url := range urls {
+		var shortURL string
+		dedupOwner := s.dedupScope.dedupOwner(url.UserID)
+		if err := s.releaseStaleOriginal(ctx, tx, url); err != nil {
+			logger.FromContext(ctx).Error("Error release stale URL", zap.Error(err))
+			return nil, err
+		}
+		err := insertStmt.QueryRowContext(ctx, url.ShortURL, url.OriginalURL, url.UserID, nullTime(url.ExpiresAt), dedupOwner).Scan(&shortURL)
+		if errors.Is(err, sql.ErrNoRows) {
+			// занятый short_url откатывает всю транзакцию
+			if err = s.conflictError(ctx, tx, url); !errors.Is(err, ErrAlreadyExistURL) {
+				return nil, err
+			}
+			resultErr = ErrAlreadyExistURL
+			err = tx.QueryRowContext(ctx, "SELECT short_url FROM shorten_urls WHERE dedup_owner = $1 AND original_url = $2",
+				dedupOwner, url.OriginalURL).Scan(&shortURL)
+		}
+		if err != nil {
+			logger.FromContext(ctx).Error("Error insert batch URL to table", zap.Error(err))
+			return nil, err
+		}
+		shortURLs = append(shortURLs, shortURL)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return shortURLs, resultErr
 }
 
-func (s *PostgreSQLStorage) InsertURL(url models.ShortenURL) (string, error) {
-	// ctx := context.Background()
+func (s *PostgreSQLStorage) InsertUser(ctx context.Context) (int, error) {
 
-	var existingShortURL string
+	var userID int
 
-	err := s.db.QueryRow(`INSERT INTO shorten_urls (short_url, original_url,user_id)
-	    VALUES ($1, $2, $3)
-	    ON CONFLICT (original_url) DO NOTHING
-	    RETURNING short_url`, url.ShortURL, url.OriginalURL, url.UserID).Scan(&existingShortURL)
+	err := s.db.QueryRowContext(ctx, `INSERT INTO users_links DEFAULT VALUES RETURNING user_id`).Scan(&userID)
 
 	if err != nil {
-		logger.Log.Error("Error Insert URL to table", zap.Error(err))
-		return "", err
+		logger.FromContext(ctx).Error("Error Insert Users", zap.Error(err))
+		return 0, err
 	}
 
-	return existingShortURL, nil
+	return userID, nil
 }
 
 // GetURL получает URL из PostgreSQL
-func (s *PostgreSQLStorage) GetURL(shortURL string) (string, error) {
-	// ctx := context.Background()
+func (s *PostgreSQLStorage) GetURL(ctx context.Context, shortURL string) (models.ShortenURL, error) {
 	var url models.ShortenURL
-	row := s.db.QueryRow("SELECT original_url FROM shorten_urls where short_url=$1 and is_deleted != true", shortURL)
-	err := row.Scan(&url.OriginalURL)
+	var expiresAt sql.NullTime
+	row := s.db.QueryRowContext(ctx, `SELECT uuid, short_url, original_url, COALESCE(user_id, 0), is_deleted, expires_at
+		FROM shorten_urls WHERE short_url = $1`, shortURL)
+	err := row.Scan(&url.UUID, &url.ShortURL, &url.OriginalURL, &url.UserID, &url.DeletedFlag, &expiresAt)
+	url.ExpiresAt = expiresAt.Time
 	if err != nil {
-		logger.Log.Error("No row selected from table", zap.Error(err))
-		return "", err
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ShortenURL{}, ErrURLNotFound
+		}
+		logger.FromContext(ctx).Error("No row selected from table", zap.Error(err))
+		return models.ShortenURL{}, err
 	}
 
-	return url.OriginalURL, nil
+	return url, nil
 }
 
-func (s *PostgreSQLStorage) GetShortURL(origURL string) (string, error) {
-	// ctx := context.Background()
+func (s *PostgreSQLStorage) GetShortURL(ctx context.Context, userID int, origURL string) (string, error) {
 	var url models.ShortenURL
-	err := s.db.QueryRow("SELECT short_url FROM shorten_urls WHERE original_url = $1", origURL).Scan(&url.ShortURL)
+	err := s.db.QueryRowContext(ctx, "SELECT short_url FROM shorten_urls WHERE dedup_owner = $1 AND original_url = $2",
+		s.dedupScope.dedupOwner(userID), origURL).Scan(&url.ShortURL)
 	if err != nil {
-		logger.Log.Error("Error in GetOrigURL. short_url", zap.Error(err))
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrURLNotFound
+		}
+		logger.FromContext(ctx).Error("Error in GetOrigURL. short_url", zap.Error(err))
 		return "", err
 	}
 	return url.ShortURL, nil
 }
 
-func (s *PostgreSQLStorage) indexExists(indexName string) (bool, error) {
-	// ctx := context.Background()
-	query := `
-		SELECT EXISTS (
-			SELECT 1
-			FROM pg_indexes
-			WHERE indexname = $1
-		)`
-	var exists bool
-	err := s.db.QueryRow(query, indexName).Scan(&exists)
+func (s *PostgreSQLStorage) GetUserURLs(ctx context.Context, userID int) ([]models.ShortenURL, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT uuid, short_url, original_url, expires_at
+		FROM shorten_urls WHERE user_id = $1 AND is_deleted = false`, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Error select user urls", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []models.ShortenURL
+	for rows.Next() {
+		url := models.ShortenURL{UserID: userID}
+		var expiresAt sql.NullTime
+		err := rows.Scan(&url.UUID, &url.ShortURL, &url.OriginalURL, &expiresAt)
+		if err != nil {
+			logger.FromContext(ctx).Error("Error scanning rows", zap.Error(err))
+			return nil, err
+		}
+		url.ExpiresAt = expiresAt.Time
+		urls = append(urls, url)
+	}
+
+	err = rows.Err()
 	if err != nil {
-		return false, err
+		logger.FromContext(ctx).Error("Error rows", zap.Error(err))
+		return nil, err
 	}
 
-	return exists, nil
+	return urls, nil
 }
 
-func (s *PostgreSQLStorage) MarkURLAsDeleted(userID int, url string) error {
-	// Обновление записи в базе данных для удаления URL, учитывая userID
-	fmt.Printf("MarkURLAsDeleted userID %d, url %s \n", userID, url)
-	query := "UPDATE shorten_urls SET is_deleted = true WHERE user_id = $1 AND short_url = $2"
-	_, err := s.db.Exec(query, userID, url)
+func (s *PostgreSQLStorage) MarkURLAsDeleted(ctx context.Context, userID int, shortURLs []string) error {
+	// Обновление записей в базе данных для удаления URL, учитывая userID.
+	// Удаленная ссылка выходит из дедупликации, чтобы тот же URL можно было сократить заново
+	logger.FromContext(ctx).Debug("Mark URLs as deleted", zap.Int("user_id", userID), zap.Strings("urls", shortURLs))
+	query := "UPDATE shorten_urls SET is_deleted = true, dedup_owner = NULL WHERE short_url = ANY($1) AND user_id = $2"
+	_, err := s.db.ExecContext(ctx, query, pq.Array(shortURLs), userID)
 	if err != nil {
-		logger.Log.Error("error update shorten_urls", zap.Error(err))
+		logger.FromContext(ctx).Error("error update shorten_urls", zap.Error(err))
 		return err
 	}
 	return nil
 }
+
+func (s *PostgreSQLStorage) DeleteExpiredURLs(ctx context.Context, before time.Time) ([]string, error) {
+	// переходы удаляются тем же запросом, иначе их увидит следующий владелец short_url
+	rows, err := s.db.QueryContext(ctx, `
+		WITH purged AS (
+			DELETE FROM shorten_urls WHERE expires_at < $1 RETURNING short_url
+		), purged_clicks AS (
+			DELETE FROM clicks WHERE short_url IN (SELECT short_url FROM purged)
+		)
+		SELECT short_url FROM purged`, before)
+	if err != nil {
+		logger.FromContext(ctx).Error("error delete expired urls", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deleted []string
+	for rows.Next() {
+		var shortURL string
+		if err := rows.Scan(&shortURL); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, shortURL)
+	}
+	return deleted, rows.Err()
+}
+
+// nullTime превращает нулевое время в NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// DB пул соединений, нужен для статистики в метриках
+func (s *PostgreSQLStorage) DB() *sql.DB {
+	return s.db
+}
+
+func (s *PostgreSQLStorage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
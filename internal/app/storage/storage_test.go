@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDSNEnv база для проверок PostgreSQLStorage. Без нее эти тесты пропускаются
+const testDSNEnv = "TEST_DATABASE_DSN"
+
+func newTestPostgreSQLStorage(t *testing.T) *PostgreSQLStorage {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	// миграции ищутся относительно корня репозитория
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir("../../.."))
+	defer os.Chdir(wd)
+
+	s, err := NewPostgreSQLStorage(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// testURLStorages MapStorage и, если задана база, PostgreSQLStorage
+func testURLStorages(t *testing.T) map[string]URLStorage {
+	storages := map[string]URLStorage{"map": NewMapStorage()}
+	if os.Getenv(testDSNEnv) != "" {
+		storages["postgres"] = newTestPostgreSQLStorage(t)
+	}
+	return storages
+}
+
+// uniqueURL URL, которого еще нет в базе от прошлых запусков
+func uniqueURL(name string) string {
+	return fmt.Sprintf("https://example.com/%s/%d", name, time.Now().UnixNano())
+}
+
+func uniqueShortURL() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func TestSaveURLReplacesExpiredOriginal(t *testing.T) {
+	for name, s := range testURLStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			originalURL := uniqueURL("expired")
+			userID, err := s.InsertUser(ctx)
+			require.NoError(t, err)
+
+			expired := models.ShortenURL{ShortURL: uniqueShortURL(), OriginalURL: originalURL, UserID: userID,
+				ExpiresAt: time.Now().Add(-time.Minute)}
+			require.NoError(t, s.SaveURL(ctx, expired))
+
+			renewed := models.ShortenURL{ShortURL: uniqueShortURL(), OriginalURL: originalURL, UserID: userID,
+				ExpiresAt: time.Now().Add(time.Hour)}
+			require.NoError(t, s.SaveURL(ctx, renewed))
+			shortURL, err := s.GetShortURL(ctx, userID, originalURL)
+			require.NoError(t, err)
+			assert.Equal(t, renewed.ShortURL, shortURL)
+
+			// действующая ссылка по-прежнему дубликат
+			assert.ErrorIs(t, s.SaveURL(ctx, models.ShortenURL{ShortURL: uniqueShortURL(), OriginalURL: originalURL, UserID: userID}),
+				ErrAlreadyExistURL)
+			shortURLs, err := s.SaveBatchURL(ctx, []models.ShortenURL{{ShortURL: uniqueShortURL(), OriginalURL: originalURL, UserID: userID}})
+			assert.ErrorIs(t, err, ErrAlreadyExistURL)
+			assert.Equal(t, []string{renewed.ShortURL}, shortURLs)
+		})
+	}
+}
+
+func TestSaveURLAfterDelete(t *testing.T) {
+	for name, s := range testURLStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			originalURL := uniqueURL("deleted")
+			userID, err := s.InsertUser(ctx)
+			require.NoError(t, err)
+
+			deleted := models.ShortenURL{ShortURL: uniqueShortURL(), OriginalURL: originalURL, UserID: userID}
+			require.NoError(t, s.SaveURL(ctx, deleted))
+			require.NoError(t, s.MarkURLAsDeleted(ctx, userID, []string{deleted.ShortURL}))
+			_, err = s.GetShortURL(ctx, userID, originalURL)
+			assert.ErrorIs(t, err, ErrURLNotFound)
+
+			shortURLs, err := s.SaveBatchURL(ctx, []models.ShortenURL{{ShortURL: uniqueShortURL(), OriginalURL: originalURL, UserID: userID}})
+			require.NoError(t, err)
+			assert.NotEqual(t, []string{deleted.ShortURL}, shortURLs)
+		})
+	}
+}
+
+func TestDeleteExpiredURLsPurgesClicks(t *testing.T) {
+	for name, s := range testURLStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			firstUser, err := s.InsertUser(ctx)
+			require.NoError(t, err)
+			secondUser, err := s.InsertUser(ctx)
+			require.NoError(t, err)
+			alias := uniqueShortURL()
+
+			require.NoError(t, s.SaveURL(ctx, models.ShortenURL{ShortURL: alias, OriginalURL: uniqueURL("first"), UserID: firstUser,
+				ExpiresAt: time.Now().Add(-time.Hour)}))
+			require.NoError(t, s.SaveClicks(ctx, []models.Click{{ShortURL: alias, ClickedAt: time.Now(), Referrer: "https://ya.ru/"}}))
+
+			deleted, err := s.DeleteExpiredURLs(ctx, time.Now())
+			require.NoError(t, err)
+			assert.Contains(t, deleted, alias)
+
+			// новый владелец псевдонима не видит переходов прежней ссылки
+			require.NoError(t, s.SaveURL(ctx, models.ShortenURL{ShortURL: alias, OriginalURL: uniqueURL("second"), UserID: secondUser}))
+			stats, err := s.GetClickStats(ctx, alias, time.Now().Add(-24*time.Hour), 5)
+			require.NoError(t, err)
+			assert.Zero(t, stats.Total)
+			assert.Empty(t, stats.TopReferrers)
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+var ErrEmailTaken = errors.New("email already registered")
+var ErrAlreadyRegistered = errors.New("user already registered")
+
+// AccountStorage учетные записи пользователей. Email хранится в нижнем регистре
+type AccountStorage interface {
+	// RegisterUser привязывает email и хеш пароля к анонимному пользователю, сохраняя его ссылки.
+	// Возвращает ErrEmailTaken, если email занят, и ErrAlreadyRegistered, если у пользователя уже есть email
+	RegisterUser(ctx context.Context, user models.User) error
+	// GetUser возвращает пользователя по id. Для анонимного пользователя email пустой
+	GetUser(ctx context.Context, userID int) (models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (models.User, error)
+	UpdatePassword(ctx context.Context, userID int, passwordHash string) error
+	// MergeUsers передает ссылки и ключи доступа анонимного пользователя fromUserID пользователю toUserID
+	MergeUsers(ctx context.Context, fromUserID, toUserID int) error
+}
+
+func (ms *MapStorage) RegisterUser(ctx context.Context, user models.User) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if existing, ok := ms.users[user.ID]; ok && existing.IsRegistered() {
+		return ErrAlreadyRegistered
+	}
+	if _, ok := ms.emails[user.Email]; ok {
+		return ErrEmailTaken
+	}
+	ms.users[user.ID] = user
+	ms.emails[user.Email] = user.ID
+	if user.ID > ms.lastUserID {
+		ms.lastUserID = user.ID
+	}
+	return nil
+}
+
+func (ms *MapStorage) GetUser(ctx context.Context, userID int) (models.User, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if user, ok := ms.users[userID]; ok {
+		return user, nil
+	}
+	// анонимные пользователи отдельно не хранятся
+	if userID <= 0 || userID > ms.lastUserID {
+		return models.User{}, ErrUserNotFound
+	}
+	return models.User{ID: userID}, nil
+}
+
+func (ms *MapStorage) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	userID, ok := ms.emails[email]
+	if !ok {
+		return models.User{}, ErrUserNotFound
+	}
+	return ms.users[userID], nil
+}
+
+func (ms *MapStorage) UpdatePassword(ctx context.Context, userID int, passwordHash string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	user, ok := ms.users[userID]
+	if !ok || !user.IsRegistered() {
+		return ErrUserNotFound
+	}
+	user.PasswordHash = passwordHash
+	ms.users[userID] = user
+	return nil
+}
+
+func (ms *MapStorage) MergeUsers(ctx context.Context, fromUserID, toUserID int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for shortURL, url := range ms.mapping {
+		if url.UserID == fromUserID {
+			ms.deleteOriginal(url)
+			url.UserID = toUserID
+			ms.mapping[shortURL] = url
+			// при дедупликации по пользователю у учетной записи может быть своя ссылка на тот же URL.
+			// Ссылка анонимного пользователя продолжает работать, но в дедупликации не участвует
+			if key, ok := ms.dedupScope.originalKey(url.UserID, url.OriginalURL); ok {
+				if _, taken := ms.originals[key]; !taken {
+					ms.originals[key] = shortURL
+				}
+			}
+		}
+	}
+	for id, key := range ms.apiKeys {
+		if key.UserID == fromUserID {
+			key.UserID = toUserID
+			ms.apiKeys[id] = key
+		}
+	}
+	return nil
+}
+
+func (s *PostgreSQLStorage) RegisterUser(ctx context.Context, user models.User) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE users_links SET email = $1, password_hash = $2, registered_at = $3
+		WHERE user_id = $4 AND email IS NULL`, user.Email, user.PasswordHash, user.RegisteredAt, user.ID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+			return ErrEmailTaken
+		}
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAlreadyRegistered
+	}
+	return nil
+}
+
+func (s *PostgreSQLStorage) GetUser(ctx context.Context, userID int) (models.User, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT user_id, email, password_hash, registered_at
+		FROM users_links WHERE user_id = $1`, userID)
+	return scanUser(row)
+}
+
+func (s *PostgreSQLStorage) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT user_id, email, password_hash, registered_at
+		FROM users_links WHERE email = $1`, email)
+	return scanUser(row)
+}
+
+func (s *PostgreSQLStorage) UpdatePassword(ctx context.Context, userID int, passwordHash string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE users_links SET password_hash = $1
+		WHERE user_id = $2 AND email IS NOT NULL`, passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *PostgreSQLStorage) MergeUsers(ctx context.Context, fromUserID, toUserID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// при дедупликации по пользователю у учетной записи может быть своя ссылка на тот же URL.
+	// Ссылка анонимного пользователя продолжает работать, но в дедупликации больше не участвует
+	if _, err := tx.ExecContext(ctx, `UPDATE shorten_urls SET dedup_owner = NULL
+		WHERE dedup_owner = $1 AND original_url IN (SELECT original_url FROM shorten_urls WHERE dedup_owner = $2)`,
+		fromUserID, toUserID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE shorten_urls
+		SET user_id = $1, dedup_owner = CASE WHEN dedup_owner = $2 THEN $1 ELSE dedup_owner END
+		WHERE user_id = $2`, toUserID, fromUserID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE api_keys SET user_id = $1 WHERE user_id = $2`, toUserID, fromUserID); err != nil {
+		return err
+	}
+	// анонимный пользователь больше не нужен
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users_links WHERE user_id = $1 AND email IS NULL`, fromUserID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func scanUser(row rowScanner) (models.User, error) {
+	var user models.User
+	var email, passwordHash sql.NullString
+	var registeredAt sql.NullTime
+	err := row.Scan(&user.ID, &email, &passwordHash, &registeredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	user.Email = email.String
+	user.PasswordHash = passwordHash.String
+	if registeredAt.Valid {
+		user.RegisteredAt = &registeredAt.Time
+	}
+	return user, nil
+}
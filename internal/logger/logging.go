@@ -7,7 +7,8 @@ import (
 	"go.uber.org/zap"
 )
 
-var Log *zap.Logger
+// Log по умолчанию ничего не пишет, пока не вызван Initialize
+var Log *zap.Logger = zap.NewNop()
 
 func Initialize(level string) error {
 	// Преобразование строки уровня логирования в объект zap.AtomicLevel
@@ -39,7 +40,7 @@ func LoggerMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(recorder, r)
 
 		duration := time.Since(startTime)
-		Log.Info("Request handled",
+		FromContext(r.Context()).Info("Request handled",
 			zap.String("method", r.Method),
 			zap.String("path", r.URL.Path),
 			zap.Duration("duration", duration),
@@ -68,7 +69,8 @@ func (rl *responseLogger) Write(data []byte) (int, error) {
 func RecoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
-			if r := recover(); r != nil {
+			if rec := recover(); rec != nil {
+				FromContext(r.Context()).Error("Panic in handler", zap.Any("panic", rec), zap.Stack("stack"))
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			}
 		}()
@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader заголовок с идентификатором запроса. Принимается от клиента и возвращается в ответе
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength длиннее идентификатор клиента не принимаем, чтобы не раздувать логи
+const maxRequestIDLength = 128
+
+type loggerContextKey struct{}
+type requestIDContextKey struct{}
+
+// WithLogger кладет логгер в контекст
+func WithLogger(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// FromContext возвращает логгер запроса, а вне запроса — общий Log
+func FromContext(ctx context.Context) *zap.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return Log
+}
+
+// WithRequestID кладет в контекст идентификатор запроса и логгер с полем request_id
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	ctx = context.WithValue(ctx, requestIDContextKey{}, requestID)
+	return WithLogger(ctx, Log.With(zap.String("request_id", requestID)))
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// NewRequestID возвращает id клиента, если он допустим, иначе генерирует новый
+func NewRequestID(clientID string) string {
+	if validRequestID(clientID) {
+		return clientID
+	}
+	return uuid.NewString()
+}
+
+// validRequestID допускает только печатные ASCII без пробелов, чтобы id нельзя было использовать для подделки строк лога
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleware принимает или выдает X-Request-ID и кладет в контекст логгер запроса.
+// Должен стоять первым, чтобы id был у всех следующих middleware
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := NewRequestID(r.Header.Get(RequestIDHeader))
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), requestID)))
+	})
+}
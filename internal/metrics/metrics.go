@@ -0,0 +1,151 @@
+// Package metrics собирает метрики сервиса в формате Prometheus
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "shortener"
+
+// этапы проверки адресов назначения в screening_blocked_total
+const (
+	StageShorten  = "shorten"
+	StageRedirect = "redirect"
+)
+
+// notFoundRoute метка запросов, не попавших ни в один маршрут, чтобы произвольные пути не раздували число серий
+const notFoundRoute = "not_found"
+
+// Registry отдельный реестр, чтобы в /metrics попадали только метрики сервиса, Go и процесса
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route pattern, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route pattern, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Storage operation latency by backend and operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"backend", "operation"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_errors_total",
+		Help:      "Failed storage operations by backend and operation.",
+	}, []string{"backend", "operation"})
+
+	screeningBlocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "screening_blocked_total",
+		Help:      "Blocked destinations by stage: shorten or redirect.",
+	}, []string{"stage"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		storageDuration,
+		storageErrors,
+		screeningBlocked,
+	)
+}
+
+// Handler отдает метрики в текстовом формате Prometheus
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Middleware считает запросы и их длительность по шаблону маршрута chi
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		// шаблон известен только после маршрутизации
+		route := notFoundRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := strconv.Itoa(recorder.statusCode)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(startTime).Seconds())
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.statusCode = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(data)
+}
+
+// ObserveStorage записывает длительность операции хранилища и ошибку, если она есть
+func ObserveStorage(backend, operation string, startTime time.Time, failed bool) {
+	storageDuration.WithLabelValues(backend, operation).Observe(time.Since(startTime).Seconds())
+	if failed {
+		storageErrors.WithLabelValues(backend, operation).Inc()
+	}
+}
+
+// ObserveBlocked считает заблокированный адрес назначения
+func ObserveBlocked(stage string) {
+	screeningBlocked.WithLabelValues(stage).Inc()
+}
+
+// RegisterDeleteQueue публикует заполненность очереди удаления URL
+func RegisterDeleteQueue(length, capacity func() int) {
+	Registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "delete_queue_length",
+			Help:      "URL deletion requests waiting in the queue.",
+		}, func() float64 { return float64(length()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "delete_queue_capacity",
+			Help:      "Capacity of the URL deletion queue.",
+		}, func() float64 { return float64(capacity()) }),
+	)
+}
+
+// RegisterDBStats публикует статистику пула соединений database/sql
+func RegisterDBStats(db *sql.DB, dbName string) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Middleware)
+	r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	})
+	r.Post("/api/shorten", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		route  string
+		status string
+	}{
+		{name: "RoutePattern", method: http.MethodGet, target: "/abc", route: "/{id}", status: "307"},
+		{name: "ImplicitOK", method: http.MethodPost, target: "/api/shorten", route: "/api/shorten", status: "200"},
+		{name: "NotFound", method: http.MethodGet, target: "/no/such/path", route: notFoundRoute, status: "404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := httpRequests.WithLabelValues(tt.route, tt.method, tt.status)
+			before := testutil.ToFloat64(counter)
+
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.target, nil))
+			assert.Equal(t, before+1, testutil.ToFloat64(counter))
+		})
+	}
+	// путь запроса в метку не попадает
+	assert.Zero(t, testutil.ToFloat64(httpRequests.WithLabelValues("/abc", http.MethodGet, "307")))
+}
+
+func TestStatusRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	recorder.WriteHeader(http.StatusCreated)
+	// повторный WriteHeader не меняет отданный статус
+	recorder.WriteHeader(http.StatusInternalServerError)
+	recorder.Write([]byte("body"))
+	assert.Equal(t, http.StatusCreated, recorder.statusCode)
+
+	recorder = &statusRecorder{ResponseWriter: httptest.NewRecorder(), statusCode: http.StatusOK}
+	recorder.Write([]byte("body"))
+	recorder.WriteHeader(http.StatusInternalServerError)
+	assert.Equal(t, http.StatusOK, recorder.statusCode)
+}
+
+func TestObserveStorage(t *testing.T) {
+	errorsBefore := testutil.ToFloat64(storageErrors.WithLabelValues("memory", "get_url"))
+	ObserveStorage("memory", "get_url", time.Now(), false)
+	ObserveStorage("memory", "get_url", time.Now(), true)
+
+	assert.Equal(t, errorsBefore+1, testutil.ToFloat64(storageErrors.WithLabelValues("memory", "get_url")))
+	count, err := testutil.GatherAndCount(Registry, "shortener_storage_operation_duration_seconds")
+	require.NoError(t, err)
+	assert.Positive(t, count)
+}
+
+func TestRegisterDeleteQueue(t *testing.T) {
+	length := 3
+	RegisterDeleteQueue(func() int { return length }, func() int { return 10 })
+
+	families, err := Registry.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetGauge() != nil {
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	assert.Equal(t, 3.0, values["shortener_delete_queue_length"])
+	assert.Equal(t, 10.0, values["shortener_delete_queue_capacity"])
+
+	// повторная регистрация — ошибка конфигурации
+	assert.Panics(t, func() { RegisterDeleteQueue(func() int { return 0 }, func() int { return 0 }) })
+}
@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// APIKey ключ доступа пользователя. Сам ключ не хранится, только его хеш
+type APIKey struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name,omitempty"`
+	KeyHash   string    `json:"key_hash"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// RevokedAt нулевое время, если ключ действует
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k APIKey) IsRevoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// HasScope ключ без областей доступа разрешает все операции
+func (k APIKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// запрос POST /api/user/keys
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// элемент ответа /api/user/keys. Key заполняется только при создании
+type APIKeyResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
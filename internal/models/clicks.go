@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Click событие перехода по короткой ссылке
+type Click struct {
+	ShortURL  string    `json:"short_url"`
+	ClickedAt time.Time `json:"clicked_at"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// IP анонимизированный адрес клиента
+	IP string `json:"ip,omitempty"`
+}
+
+// ответ GET /api/user/urls/{id}/stats
+type ClickStats struct {
+	ShortURL     string           `json:"short_url"`
+	Total        int              `json:"total"`
+	Daily        []DailyClicks    `json:"daily"`
+	TopReferrers []ReferrerClicks `json:"top_referrers"`
+}
+
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+type ReferrerClicks struct {
+	Referrer string `json:"referrer"`
+	Clicks   int    `json:"clicks"`
+}
@@ -1,9 +1,18 @@
 package models
 
+import "time"
+
 type ShortenURL struct {
 	UUID        int
 	ShortURL    string
 	OriginalURL string
 	UserID      int
 	DeletedFlag bool
+	// ExpiresAt нулевое значение означает бессрочную ссылку
+	ExpiresAt time.Time
+}
+
+// IsExpired проверяет, истек ли срок жизни ссылки к моменту now
+func (u ShortenURL) IsExpired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt)
 }
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// IdempotencyRecord запрос пользователя с заголовком Idempotency-Key и его ответ.
+// StatusCode 0 — запрос еще выполняется
+type IdempotencyRecord struct {
+	UserID      int       `json:"user_id"`
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_hash"`
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// IsCompleted ответ на запрос уже сохранен
+func (r IdempotencyRecord) IsCompleted() bool {
+	return r.StatusCode != 0
+}
@@ -1,21 +1,62 @@
 package models
 
+import "time"
+
 type Response struct {
 	Result string `json:"result"`
 }
 
 type Request struct {
-	URL string `json:"url"`
+	URL         string     `json:"url"`
+	CustomAlias string     `json:"custom_alias,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds  int64      `json:"ttl_seconds,omitempty"`
 }
 
 // request
-type BatchShortenRequest []struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+type BatchShortenRequest []BatchShortenRequestItem
+
+// BatchShortenRequestItem элемент запроса на сокращение пачки
+type BatchShortenRequestItem struct {
+	CorrelationID string     `json:"correlation_id"`
+	OriginalURL   string     `json:"original_url"`
+	CustomAlias   string     `json:"custom_alias,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds    int64      `json:"ttl_seconds,omitempty"`
 }
 
 // response
-type BatchShortenResponse []struct {
+type BatchShortenResponse []BatchShortenResponseItem
+
+// BatchShortenResponseItem элемент ответа на сокращение пачки
+type BatchShortenResponseItem struct {
 	CorrelationID string `json:"correlation_id"`
 	ShortURL      string `json:"short_url"`
 }
+
+// элемент ответа GET /api/user/urls
+type UserURL struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// ErrorResponse ошибка с машиночитаемым кодом
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// BatchItemError ошибка проверки элемента пачки
+type BatchItemError struct {
+	CorrelationID string `json:"correlation_id"`
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+}
+
+// BatchErrorResponse ответ 400 на пачку с ошибками всех неверных элементов
+type BatchErrorResponse struct {
+	Code    string           `json:"code"`
+	Message string           `json:"message"`
+	Errors  []BatchItemError `json:"errors"`
+}
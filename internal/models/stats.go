@@ -0,0 +1,10 @@
+package models
+
+// Stats ответ GET /api/internal/stats. URLs — все хранимые ссылки, включая удаленные и истекшие.
+// Users — пользователи, у которых есть ссылки, и зарегистрированные
+type Stats struct {
+	URLs    int `json:"urls"`
+	Users   int `json:"users"`
+	Deleted int `json:"deleted"`
+	Expired int `json:"expired"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// User пользователь сервиса. У анонимного пользователя нет email и пароля
+type User struct {
+	ID           int    `json:"id"`
+	Email        string `json:"email,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	// время регистрации, nil у анонимного пользователя
+	RegisteredAt *time.Time `json:"registered_at,omitempty"`
+}
+
+func (u User) IsRegistered() bool {
+	return u.Email != ""
+}
+
+// запрос POST /api/user/register и /api/user/login
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// запрос POST /api/user/password
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// ответ регистрации и входа
+type UserResponse struct {
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+}
@@ -0,0 +1,164 @@
+package screening
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tokebay/yandex/internal/logger"
+	"go.uber.org/zap"
+	"golang.org/x/net/idna"
+)
+
+// regexPrefix отмечает в файле регулярное выражение, которое сравнивается со всем URL
+const regexPrefix = "re:"
+
+// Blocklist домены и регулярные выражения из файла. Формат — правило на строку, # начинает комментарий:
+//
+//	# домен и все его поддомены
+//	example.com
+//	# регулярное выражение для всего URL, # в нем комментарием не считается
+//	re:^https?://[^/]+/phish
+type Blocklist struct {
+	path string
+
+	mu      sync.RWMutex
+	domains map[string]struct{}
+	regexps []*regexp.Regexp
+	modTime time.Time
+	size    int64
+}
+
+// LoadBlocklist читает список блокировки. Ошибка в любом правиле — ошибка загрузки
+func LoadBlocklist(path string) (*Blocklist, error) {
+	b := &Blocklist{path: path}
+	if _, err := b.reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Match ищет правило для хоста и URL. host в нижнем регистре, IDN — в punycode
+func (b *Blocklist) Match(host, rawURL string) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// домен блокирует и все поддомены
+	for domain := strings.TrimSuffix(host, "."); domain != ""; {
+		if _, ok := b.domains[domain]; ok {
+			return "domain " + domain, true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	for _, re := range b.regexps {
+		if re.MatchString(rawURL) {
+			return "rule " + re.String(), true
+		}
+	}
+	return "", false
+}
+
+// Watch перечитывает файл при изменении времени модификации или размера. Работает до отмены ctx.
+// Если в новом файле ошибка, остается прежний список
+func (b *Blocklist) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := b.reload()
+			if err != nil {
+				logger.FromContext(ctx).Error("Error reloading blocklist", zap.String("path", b.path), zap.Error(err))
+				continue
+			}
+			if reloaded {
+				logger.FromContext(ctx).Info("Blocklist reloaded", zap.String("path", b.path), zap.Int("rules", b.Len()))
+			}
+		}
+	}
+}
+
+// Len число правил
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.domains) + len(b.regexps)
+}
+
+// reload перечитывает файл, если он изменился
+func (b *Blocklist) reload() (bool, error) {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return false, err
+	}
+	b.mu.RLock()
+	unchanged := info.ModTime().Equal(b.modTime) && info.Size() == b.size
+	b.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return false, err
+	}
+	domains, regexps, err := parseBlocklist(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", b.path, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.domains, b.regexps = domains, regexps
+	b.modTime, b.size = info.ModTime(), info.Size()
+	return true, nil
+}
+
+func parseBlocklist(data []byte) (map[string]struct{}, []*regexp.Regexp, error) {
+	domains := make(map[string]struct{})
+	var regexps []*regexp.Regexp
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		rule := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(rule), regexPrefix) {
+			// в регулярном выражении # не комментарий
+			re, err := regexp.Compile(strings.TrimPrefix(strings.TrimSpace(rule), regexPrefix))
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			regexps = append(regexps, re)
+			continue
+		}
+		if i := strings.IndexByte(rule, '#'); i >= 0 {
+			rule = rule[:i]
+		}
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		domain, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.TrimPrefix(rule, "*."), "."))
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: invalid domain %q", line, rule)
+		}
+		domains[domain] = struct{}{}
+	}
+	return domains, regexps, scanner.Err()
+}
@@ -0,0 +1,109 @@
+package screening
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPLookup сервис проверки по HTTP. Запрос — POST с {"url": "..."}, ответ — {"blocked": bool, "reason": "..."}
+type HTTPLookup struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewHTTPLookup(endpoint string, timeout time.Duration) *HTTPLookup {
+	return &HTTPLookup{endpoint: endpoint, client: &http.Client{Timeout: timeout}}
+}
+
+type lookupRequest struct {
+	URL string `json:"url"`
+}
+
+type lookupResponse struct {
+	Blocked bool   `json:"blocked"`
+	Reason  string `json:"reason"`
+}
+
+func (l *HTTPLookup) Lookup(ctx context.Context, rawURL string) (Verdict, error) {
+	body, err := json.Marshal(lookupRequest{URL: rawURL})
+	if err != nil {
+		return Verdict{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Verdict{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Verdict{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var verdict lookupResponse
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return Verdict{}, fmt.Errorf("decode response: %w", err)
+	}
+	return Verdict{Blocked: verdict.Blocked, Reason: verdict.Reason}, nil
+}
+
+// FakeLookup сервис проверки в памяти для тестов и локального запуска. Блокирует URL по подстроке
+type FakeLookup struct {
+	mu      sync.Mutex
+	blocked map[string]string
+	err     error
+	calls   int
+}
+
+func NewFakeLookup() *FakeLookup {
+	return &FakeLookup{blocked: make(map[string]string)}
+}
+
+// Block блокирует все URL, содержащие substr
+func (f *FakeLookup) Block(substr, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.blocked[substr] = reason
+}
+
+// SetError задает ошибку всех следующих проверок, например чтобы изобразить недоступность сервиса
+func (f *FakeLookup) SetError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.err = err
+}
+
+// Calls число обращений к сервису
+func (f *FakeLookup) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls
+}
+
+func (f *FakeLookup) Lookup(ctx context.Context, rawURL string) (Verdict, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.err != nil {
+		return Verdict{}, f.err
+	}
+	for substr, reason := range f.blocked {
+		if strings.Contains(rawURL, substr) {
+			return Verdict{Blocked: true, Reason: reason}, nil
+		}
+	}
+	return Verdict{}, nil
+}
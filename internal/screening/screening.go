@@ -0,0 +1,79 @@
+// Package screening проверяет адреса назначения перед сокращением и переходом по ссылке:
+// локальный список блокировки и, если задан, внешний сервис проверки
+package screening
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var ErrBlocked = errors.New("destination is blocked")
+
+// ErrLookupUnavailable сервис проверки не ответил
+var ErrLookupUnavailable = errors.New("url screening service is unavailable")
+
+// Verdict ответ сервиса проверки
+type Verdict struct {
+	Blocked bool
+	Reason  string
+}
+
+// Lookup внешний сервис проверки URL
+type Lookup interface {
+	Lookup(ctx context.Context, rawURL string) (Verdict, error)
+}
+
+// Screener проверяет URL по списку блокировки и сервису проверки. Оба необязательны
+type Screener struct {
+	blocklist *Blocklist
+	lookup    Lookup
+}
+
+func New(blocklist *Blocklist, lookup Lookup) *Screener {
+	return &Screener{blocklist: blocklist, lookup: lookup}
+}
+
+// Check проверяет URL перед сокращением. Заблокированный URL — ErrBlocked с причиной,
+// сбой сервиса проверки — ErrLookupUnavailable
+func (s *Screener) Check(ctx context.Context, rawURL string) error {
+	if err := s.CheckLocal(rawURL); err != nil {
+		return err
+	}
+	if s.lookup == nil {
+		return nil
+	}
+	verdict, err := s.lookup.Lookup(ctx, rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrLookupUnavailable, err)
+	}
+	if verdict.Blocked {
+		return blockedError(verdict.Reason)
+	}
+	return nil
+}
+
+// CheckLocal проверяет URL только по списку блокировки. Нужна при переходе по ссылке,
+// где запрос к внешнему сервису на каждый клик слишком дорог
+func (s *Screener) CheckLocal(rawURL string) error {
+	if s.blocklist == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	if reason, ok := s.blocklist.Match(strings.ToLower(u.Hostname()), rawURL); ok {
+		return blockedError(reason)
+	}
+	return nil
+}
+
+func blockedError(reason string) error {
+	if reason == "" {
+		return ErrBlocked
+	}
+	return fmt.Errorf("%w: %s", ErrBlocked, reason)
+}
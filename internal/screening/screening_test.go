@@ -0,0 +1,118 @@
+package screening
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBlocklist(t *testing.T, path, content string, modTime time.Time) {
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	// время модификации задаем явно, чтобы изменение было видно при любой точности часов файловой системы
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	writeBlocklist(t, path, `
+# фишинг
+evil.example
+*.Phish.Test.
+пример.рф
+re:^https?://[^/]+/login#steal
+`, time.Now().Add(-time.Hour))
+
+	blocklist, err := LoadBlocklist(path)
+	require.NoError(t, err)
+	assert.Equal(t, 4, blocklist.Len())
+	screener := New(blocklist, nil)
+
+	tests := []struct {
+		name    string
+		rawURL  string
+		blocked bool
+	}{
+		{name: "Domain", rawURL: "https://evil.example/", blocked: true},
+		{name: "Subdomain", rawURL: "https://www.EVIL.example/path", blocked: true},
+		{name: "SimilarDomain", rawURL: "https://notevil.example/"},
+		{name: "Wildcard", rawURL: "http://phish.test", blocked: true},
+		{name: "IDN", rawURL: "https://xn--e1afmkfd.xn--p1ai/", blocked: true},
+		{name: "Regexp", rawURL: "https://bank.test/login#steal", blocked: true},
+		{name: "Allowed", rawURL: "https://go.dev/login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := screener.Check(context.Background(), tt.rawURL)
+			if tt.blocked {
+				assert.ErrorIs(t, err, ErrBlocked)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// измененный файл перечитывается, файл с ошибкой не заменяет рабочий список
+	writeBlocklist(t, path, "go.dev\n", time.Now())
+	reloaded, err := blocklist.reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.ErrorIs(t, screener.CheckLocal("https://go.dev/"), ErrBlocked)
+	assert.NoError(t, screener.CheckLocal("https://evil.example/"))
+
+	writeBlocklist(t, path, "re:(\n", time.Now().Add(time.Minute))
+	_, err = blocklist.reload()
+	assert.Error(t, err)
+	assert.ErrorIs(t, screener.CheckLocal("https://go.dev/"), ErrBlocked)
+}
+
+func TestHTTPLookup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req lookupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.URL {
+		case "https://phishing.test/":
+			json.NewEncoder(w).Encode(lookupResponse{Blocked: true, Reason: "phishing"})
+		case "https://broken.test/":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(lookupResponse{})
+		}
+	}))
+	defer server.Close()
+
+	screener := New(nil, NewHTTPLookup(server.URL, time.Second))
+	ctx := context.Background()
+
+	assert.NoError(t, screener.Check(ctx, "https://go.dev/"))
+	err := screener.Check(ctx, "https://phishing.test/")
+	assert.ErrorIs(t, err, ErrBlocked)
+	assert.Contains(t, err.Error(), "phishing")
+	assert.ErrorIs(t, screener.Check(ctx, "https://broken.test/"), ErrLookupUnavailable)
+	// при переходе по ссылке сервис не вызывается
+	assert.NoError(t, screener.CheckLocal("https://phishing.test/"))
+}
+
+func TestFakeLookup(t *testing.T) {
+	lookup := NewFakeLookup()
+	lookup.Block("phishing.test", "phishing")
+	screener := New(nil, lookup)
+	ctx := context.Background()
+
+	assert.ErrorIs(t, screener.Check(ctx, "https://phishing.test/"), ErrBlocked)
+	assert.NoError(t, screener.Check(ctx, "https://go.dev/"))
+	lookup.SetError(errors.New("timeout"))
+	assert.ErrorIs(t, screener.Check(ctx, "https://go.dev/"), ErrLookupUnavailable)
+	assert.Equal(t, 3, lookup.Calls())
+}
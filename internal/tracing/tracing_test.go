@@ -0,0 +1,114 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Tokebay/yandex/config"
+	"github.com/Tokebay/yandex/internal/app/storage"
+	"github.com/Tokebay/yandex/internal/models"
+	"github.com/Tokebay/yandex/internal/tracing"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setupExporter подменяет глобальный TracerProvider на провайдер с экспортом в память
+func setupExporter(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defaultProvider, defaultPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(defaultProvider)
+		otel.SetTextMapPropagator(defaultPropagator)
+	})
+	return exporter
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, span := range spans {
+		if span.Name == name {
+			return span, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestMiddlewareStorageChildSpan(t *testing.T) {
+	exporter := setupExporter(t)
+
+	urlStorage := storage.NewInstrumentedStorage(storage.NewMapStorage(), "memory")
+	require.NoError(t, urlStorage.SaveURL(context.Background(), models.ShortenURL{ShortURL: "abc", OriginalURL: "https://ya.ru/", UserID: 1}))
+	exporter.Reset()
+
+	r := chi.NewRouter()
+	r.Use(tracing.Middleware)
+	r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		url, err := urlStorage.GetURL(r.Context(), chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, url.OriginalURL, http.StatusTemporaryRedirect)
+	})
+
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req := httptest.NewRequest(http.MethodGet, "/abc", nil)
+	req.Header.Set("traceparent", parent)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+
+	spans := exporter.GetSpans()
+	server, ok := findSpan(spans, "GET /{id}")
+	require.True(t, ok, "server span not found")
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind)
+	// трасса продолжает traceparent клиента
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", server.SpanContext.TraceID().String())
+	assert.Equal(t, "b7ad6b7169203331", server.Parent.SpanID().String())
+
+	child, ok := findSpan(spans, "storage.get_url")
+	require.True(t, ok, "storage span not found")
+	assert.Equal(t, server.SpanContext.TraceID(), child.SpanContext.TraceID())
+	assert.Equal(t, server.SpanContext.SpanID(), child.Parent.SpanID())
+}
+
+func TestEnd(t *testing.T) {
+	exporter := setupExporter(t)
+
+	_, span := tracing.Start(context.Background(), "ok")
+	tracing.End(span, nil)
+	_, span = tracing.Start(context.Background(), "failed")
+	tracing.End(span, errors.New("boom"))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+	assert.Equal(t, "boom", spans[1].Status.Description)
+	assert.Len(t, spans[1].Events, 1)
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	defaultPropagator := otel.GetTextMapPropagator()
+	defer otel.SetTextMapPropagator(defaultPropagator)
+
+	shutdown, err := tracing.Setup(context.Background(), &config.Config{TracingExporter: tracing.ExporterNone})
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = tracing.Setup(context.Background(), &config.Config{TracingExporter: "jaeger"})
+	assert.Error(t, err)
+}
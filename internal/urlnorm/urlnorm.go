@@ -0,0 +1,126 @@
+// Package urlnorm проверяет и приводит к единому виду URL перед сокращением
+package urlnorm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// DefaultMaxLength ограничение длины URL по умолчанию, которое понимают все распространенные браузеры
+const DefaultMaxLength = 2048
+
+var ErrInvalidURL = errors.New("invalid url")
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Options настройки нормализации. MaxLength 0 — DefaultMaxLength
+type Options struct {
+	MaxLength     int
+	StripFragment bool
+}
+
+// Normalize проверяет, что rawURL — абсолютный http(s) URL без учетных данных, и приводит его к единому виду:
+// схема и хост в нижнем регистре, IDN в punycode, без порта по умолчанию и, если задано, без фрагмента.
+// Путь и параметры не меняются
+func Normalize(rawURL string, opts Options) (string, error) {
+	maxLength := opts.MaxLength
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLength
+	}
+
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "", fmt.Errorf("%w: url is empty", ErrInvalidURL)
+	}
+	if len(rawURL) > maxLength {
+		return "", fmt.Errorf("%w: url is longer than %d bytes", ErrInvalidURL, maxLength)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidURL, parseErrorReason(err))
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[u.Scheme]; !ok || u.Opaque != "" {
+		return "", fmt.Errorf("%w: only absolute http and https URLs are allowed", ErrInvalidURL)
+	}
+	if u.User != nil {
+		return "", fmt.Errorf("%w: credentials in url are not allowed", ErrInvalidURL)
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return "", fmt.Errorf("%w: invalid port %q", ErrInvalidURL, port)
+		}
+	}
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	u.Host = host
+	if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+
+	if opts.StripFragment {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+
+	normalized := u.String()
+	// punycode длиннее исходного хоста
+	if len(normalized) > maxLength {
+		return "", fmt.Errorf("%w: url is longer than %d bytes", ErrInvalidURL, maxLength)
+	}
+	return normalized, nil
+}
+
+// IsHTTP абсолютный http(s) URL с хостом. Проверка для URL, сохраненных до нормализации
+func IsHTTP(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return (scheme == "http" || scheme == "https") && u.Opaque == "" && u.Host != ""
+}
+
+// normalizeHost переводит имя хоста в нижний регистр и punycode. IP-адреса возвращаются как есть
+func normalizeHost(host string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("%w: host is empty", ErrInvalidURL)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return strings.ToLower(host), nil
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid host %q", ErrInvalidURL, host)
+	}
+	return ascii, nil
+}
+
+// parseErrorReason текст ошибки url.Parse без повторения всего URL
+func parseErrorReason(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err.Error()
+	}
+	return err.Error()
+}